@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/vishvananda/netlink"
+)
+
+// the host configuration of the devices attached to each container is cached
+// on ADD so DEL can restore it, the addresses are removed by the kernel when
+// the device changes of namespace
+const hostStateDir = "/var/lib/cni/netdevice"
+
+// hostState is the configuration of a device in the host namespace, the name
+// of its interface in the pod and the pod namespace
+type hostState struct {
+	Name      string   `json:"name"`
+	Interface string   `json:"interface,omitempty"`
+	NetNS     string   `json:"netns,omitempty"`
+	Alias     string   `json:"alias,omitempty"`
+	HWAddr    string   `json:"hwaddr,omitempty"`
+	MTU       int      `json:"mtu,omitempty"`
+	Up        bool     `json:"up,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+func newHostState(link netlink.Link) (*hostState, error) {
+	attrs := link.Attrs()
+	state := &hostState{
+		Name:   attrs.Name,
+		Alias:  attrs.Alias,
+		HWAddr: attrs.HardwareAddr.String(),
+		MTU:    attrs.MTU,
+		Up:     attrs.Flags&net.FlagUp != 0,
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the addresses of %q: %v", attrs.Name, err)
+	}
+	for _, addr := range addrs {
+		// the link local addresses are generated again by the kernel
+		if addr.Scope != int(netlink.SCOPE_UNIVERSE) {
+			continue
+		}
+		state.Addresses = append(state.Addresses, addr.IPNet.String())
+	}
+	return state, nil
+}
+
+// attachment identifies the ADD of a container to a network, the states are
+// cached by attachment so the plugin can be used in several networks and GC
+// only collects the states of its network
+type attachment struct {
+	Network     string
+	ContainerID string
+	IfName      string
+}
+
+func newAttachment(cfg *NetConf, args *skel.CmdArgs) attachment {
+	return attachment{Network: cfg.Name, ContainerID: args.ContainerID, IfName: args.IfName}
+}
+
+// hostStatePath returns /var/lib/cni/netdevice/<network>/<container>/<ifname>.json
+func hostStatePath(a attachment) string {
+	return filepath.Join(hostStateDir, a.Network, a.ContainerID, a.IfName+".json")
+}
+
+// loadHostStates returns the states cached for the attachment, none if the
+// container has no devices or they were already restored
+func loadHostStates(a attachment) ([]*hostState, error) {
+	data, err := os.ReadFile(hostStatePath(a))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	states := []*hostState{}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("invalid host state of container %s interface %s: %v", a.ContainerID, a.IfName, err)
+	}
+	return states, nil
+}
+
+// saveHostStates writes the states of the attachment replacing the previous
+// ones atomically
+func saveHostStates(a attachment, states []*hostState) error {
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(hostStatePath(a))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+a.IfName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), hostStatePath(a))
+}
+
+// hostStateAttachments returns the attachments of the network with cached
+// states
+func hostStateAttachments(network string) ([]attachment, error) {
+	containers, err := os.ReadDir(filepath.Join(hostStateDir, network))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	attachments := []attachment{}
+	for _, container := range containers {
+		if !container.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(hostStateDir, network, container.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			// skip the temporary files of the states being written
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || filepath.Ext(entry.Name()) != ".json" {
+				continue
+			}
+			attachments = append(attachments, attachment{
+				Network:     network,
+				ContainerID: container.Name(),
+				IfName:      strings.TrimSuffix(entry.Name(), ".json"),
+			})
+		}
+	}
+	return attachments, nil
+}
+
+// deleteHostStates removes the states of the attachment and the directory of
+// the container once it has no other attachments
+func deleteHostStates(a attachment) error {
+	if err := os.Remove(hostStatePath(a)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dir := filepath.Dir(hostStatePath(a))
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHostStateDir verifies that the states can be written, ADD fails
+// without them
+func checkHostStateDir() error {
+	if err := os.MkdirAll(hostStateDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(hostStateDir, ".status")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	return tmp.Close()
+}
+
+// restoreHostLink restores the configuration of the device in the host
+// namespace, the device is down after it is moved out of the container. The
+// kernel returns the physical devices with the name they had in the pod when
+// the namespace is destroyed, the virtual devices are destroyed with it.
+func restoreHostLink(state *hostState) error {
+	link, err := netlink.LinkByName(state.Name)
+	if err != nil {
+		link, err = linkByAlias(state.Name)
+		if err != nil {
+			return err
+		}
+		// the virtual devices are destroyed with the pod
+		if link == nil {
+			return nil
+		}
+		if err := netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", link.Attrs().Name, err)
+		}
+		if err := netlink.LinkSetName(link, state.Name); err != nil {
+			return fmt.Errorf("failed to rename %q back to %q: %v", link.Attrs().Name, state.Name, err)
+		}
+	}
+	attrs := link.Attrs()
+	if state.MTU > 0 && attrs.MTU != state.MTU {
+		if err := netlink.LinkSetMTU(link, state.MTU); err != nil {
+			return fmt.Errorf("failed to restore MTU %d: %v", state.MTU, err)
+		}
+	}
+	if state.HWAddr != "" && attrs.HardwareAddr.String() != state.HWAddr {
+		hwAddr, err := net.ParseMAC(state.HWAddr)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetHardwareAddr(link, hwAddr); err != nil {
+			return fmt.Errorf("failed to restore hardware address %s: %v", hwAddr, err)
+		}
+	}
+	if err := netlink.LinkSetAlias(link, state.Alias); err != nil {
+		return fmt.Errorf("failed to restore alias: %v", err)
+	}
+	for _, address := range state.Addresses {
+		addr, err := netlink.ParseAddr(address)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			return fmt.Errorf("failed to restore address %s: %v", address, err)
+		}
+	}
+	if state.Up {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set up: %v", err)
+		}
+	}
+	return nil
+}
+
+// linkByAlias returns the host link with the alias, nil if there is none
+func linkByAlias(alias string) (netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list node links: %v", err)
+	}
+	for _, link := range links {
+		if link.Attrs().Alias == alias {
+			return link, nil
+		}
+	}
+	return nil, nil
+}
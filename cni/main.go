@@ -4,7 +4,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/vishvananda/netlink"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
@@ -26,6 +29,13 @@ import (
 const (
 	// containerd annotation
 	NetInterfacesAnnotation = "networking.k8s.io/interfaces"
+	// the interfaces attached from the annotation are named net1, net2, ...
+	// inside the pod, args.IfName is the interface of the primary network
+	podInterfacePrefix = "net"
+	// IFNAMSIZ includes the terminating null byte
+	maxInterfaceNameLen = 15
+	// CNI 1.1 STATUS error code of the plugins that can not serve ADD
+	errPluginNotAvailable uint = 50
 )
 
 // https://docs.kernel.org/networking/netdevices.html
@@ -82,8 +92,13 @@ func loadConf(bytes []byte) (*NetConf, *current.Result, error) {
 func loadInterfaces(bytes []byte) ([]Ifreq, error) {
 	n := []Ifreq{}
 	var err error
-	if err = json.Unmarshal(bytes, n); err != nil {
-		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	if err = json.Unmarshal(bytes, &n); err != nil {
+		return nil, fmt.Errorf("failed to load interfaces from annotation %s: %v", NetInterfacesAnnotation, err)
+	}
+	for i, iface := range n {
+		if iface.Name == "" && iface.HWAddr == "" {
+			return nil, fmt.Errorf("interface %d in annotation %s has no name nor hwaddr", i, NetInterfacesAnnotation)
+		}
 	}
 	return n, nil
 }
@@ -94,10 +109,13 @@ type Ifreq struct {
 	Address   string `json:"address,omitempty"`
 	Broadcast string `json:"broadcast,omitempty"`
 	Netmask   string `json:"netmask,omitempty"`
-	HWAddr    string `json:"hwaddr,omitempty"`
-	Flags     byte   `json:"flags,omitempty"`
-	Ifindex   int    `json:"ifindex,omitempty"`
-	MTU       int    `json:"mtu,omitempty"`
+	// HWAddr only selects the device in the host, alone or together with
+	// the name, the hardware address set in the pod is MAC
+	HWAddr  string `json:"hwaddr,omitempty"`
+	MAC     string `json:"mac,omitempty"`
+	Flags   byte   `json:"flags,omitempty"`
+	Ifindex int    `json:"ifindex,omitempty"`
+	MTU     int    `json:"mtu,omitempty"`
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
@@ -126,7 +144,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	interfaces, err := loadInterfaces([]byte(kni))
 	if err != nil {
 		fmt.Fprintf(f, "error trying to get the interfaces %#v\n", kni)
-		// return err
+		return err
 	}
 
 	fmt.Fprintf(f, "received interfaces %#v\n", interfaces)
@@ -137,16 +155,34 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer containerNs.Close()
 
+	// DEL restores the devices attached, including the ones attached
+	// before a failure since the runtime calls DEL after a failed ADD
+	a := newAttachment(cfg, args)
+	states := []*hostState{}
 	for _, iface := range interfaces {
-		var contDev netlink.Link
 		hostDev, err := getLink(iface.Name, iface.HWAddr)
 		if err != nil {
-			return fmt.Errorf("failed to find host device: %v", err)
+			return fmt.Errorf("failed to find host device %s: %v", ifreqID(iface), err)
+		}
+		ifName, err := podInterfaceName(containerNs)
+		if err != nil {
+			return err
+		}
+
+		state, err := newHostState(hostDev)
+		if err != nil {
+			return err
+		}
+		state.Interface = ifName
+		state.NetNS = containerNs.Path()
+		states = append(states, state)
+		if err := saveHostStates(a, states); err != nil {
+			return err
 		}
 
-		contDev, err = moveLinkIn(hostDev, containerNs, args.IfName)
+		contDev, addr, err := moveLinkIn(hostDev, containerNs, ifName, iface)
 		if err != nil {
-			return fmt.Errorf("failed to move link %v", err)
+			return fmt.Errorf("failed to move link %s: %v", ifreqID(iface), err)
 		}
 
 		result.Interfaces = append(result.Interfaces, &current.Interface{
@@ -154,11 +190,85 @@ func cmdAdd(args *skel.CmdArgs) error {
 			Mac:     contDev.Attrs().HardwareAddr.String(),
 			Sandbox: containerNs.Path(),
 		})
+		if addr != nil {
+			result.IPs = append(result.IPs, &current.IPConfig{
+				Interface: current.Int(len(result.Interfaces) - 1),
+				Address:   *addr.IPNet,
+			})
+		}
 	}
 
 	return types.PrintResult(result, cfg.CNIVersion)
 }
 
+// ifreqID identifies the interface of the annotation in the errors
+func ifreqID(iface Ifreq) string {
+	if iface.Name != "" {
+		return iface.Name
+	}
+	return iface.HWAddr
+}
+
+// ifreqAddr returns the address of the interface of the annotation, the
+// address is a CIDR or an IP with the netmask in its own field
+func ifreqAddr(iface Ifreq) (*netlink.Addr, error) {
+	if iface.Address == "" {
+		return nil, nil
+	}
+	addr, err := netlink.ParseAddr(iface.Address)
+	if err != nil {
+		ip := net.ParseIP(iface.Address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", iface.Address)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		mask := net.CIDRMask(bits, bits)
+		if iface.Netmask != "" {
+			maskIP := net.ParseIP(iface.Netmask)
+			if maskIP == nil {
+				return nil, fmt.Errorf("invalid netmask %q", iface.Netmask)
+			}
+			if bits == 8*net.IPv4len {
+				maskIP = maskIP.To4()
+			}
+			mask = net.IPMask(maskIP)
+			if ones, maskBits := mask.Size(); maskBits != bits || (ones == 0 && !maskIP.IsUnspecified()) {
+				return nil, fmt.Errorf("invalid netmask %q for address %q", iface.Netmask, iface.Address)
+			}
+		}
+		addr = &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: mask}}
+	}
+	if iface.Broadcast != "" {
+		addr.Broadcast = net.ParseIP(iface.Broadcast)
+		if addr.Broadcast == nil {
+			return nil, fmt.Errorf("invalid broadcast %q", iface.Broadcast)
+		}
+	}
+	return addr, nil
+}
+
+// podInterfaceName returns the first name with the podInterfacePrefix that is
+// not used in the container namespace
+func podInterfaceName(containerNs ns.NetNS) (string, error) {
+	var name string
+	err := containerNs.Do(func(_ ns.NetNS) error {
+		for i := 1; ; i++ {
+			name = fmt.Sprintf("%s%d", podInterfacePrefix, i)
+			if len(name) > maxInterfaceNameLen {
+				return fmt.Errorf("no free interface name in the container namespace")
+			}
+			if _, err := netlink.LinkByName(name); err != nil {
+				return nil
+			}
+		}
+	})
+	return name, err
+}
+
 func cmdDel(args *skel.CmdArgs) error {
 	fmt.Fprintf(f, "----------- CMD DEL\n")
 	cfg, _, err := loadConf(args.StdinData)
@@ -167,14 +277,16 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 
 	fmt.Fprintf(f, "DEL received config %#v\n", cfg)
-	if args.Netns == "" {
-		return nil
-	}
-	containerNs, err := ns.GetNS(args.Netns)
+	// DEL may be called several times and for attachments that failed or
+	// were never added, the missing devices and namespaces are not errors
+	a := newAttachment(cfg, args)
+	states, err := loadHostStates(a)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return err
+	}
+	if err := releaseDevices(a, args.Netns, states); err != nil {
+		return err
 	}
-	defer containerNs.Close()
 
 	if cfg.IPAM.Type != "" {
 		if err := ipam.ExecDel(cfg.IPAM.Type, args.StdinData); err != nil {
@@ -182,16 +294,164 @@ func cmdDel(args *skel.CmdArgs) error {
 		}
 	}
 
-	// if err := moveLinkOut(containerNs, args.IfName); err != nil {
-	//	return err
-	//}
+	return nil
+}
+
+// releaseDevices returns the devices of the attachment to the host namespace
+// and restores their host configuration, the cached states are removed once
+// all the devices are back.
+func releaseDevices(a attachment, netnsPath string, states []*hostState) error {
+	var errs []error
+	if netnsPath != "" {
+		containerNs, err := ns.GetNS(netnsPath)
+		switch err.(type) {
+		case nil:
+			defer containerNs.Close()
+			errs = append(errs, moveLinksOut(containerNs, states)...)
+		case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+			// the kernel returns the physical devices to the host
+			// namespace when the namespace is destroyed
+		default:
+			return fmt.Errorf("failed to open netns %q: %v", netnsPath, err)
+		}
+	}
+	for _, state := range states {
+		if err := restoreHostLink(state); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore device %s: %v", state.Name, err))
+		}
+	}
+	// the runtime retries DEL until it succeeds, keep the states until all
+	// the devices are back
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return deleteHostStates(a)
+}
+
+// cmdGC returns the devices of the attachments of the network that are not in
+// the valid attachments of the runtime, like the devices leaked by pods whose
+// DEL never succeeded, and lets the IPAM plugin collect its leaked allocations.
+// The devices are found from the cached states of the attachments.
+func cmdGC(args *skel.CmdArgs) error {
+	cfg, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	valid := map[attachment]bool{}
+	for _, v := range cfg.ValidAttachments {
+		valid[attachment{Network: cfg.Name, ContainerID: v.ContainerID, IfName: v.IfName}] = true
+	}
+	attachments, err := hostStateAttachments(cfg.Name)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, a := range attachments {
+		if valid[a] {
+			continue
+		}
+		states, err := loadHostStates(a)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		netnsPath := ""
+		if len(states) > 0 {
+			netnsPath = states[0].NetNS
+		}
+		if err := releaseDevices(a, netnsPath, states); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release the devices of container %s interface %s: %v", a.ContainerID, a.IfName, err))
+		}
+	}
 
+	// the IPAM plugin receives the valid attachments in the same config
+	if cfg.IPAM.Type != "" {
+		if err := invoke.DelegateGC(context.TODO(), cfg.IPAM.Type, args.StdinData, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cmdStatus reports that the plugin is not available only if it can not serve
+// ADD. A node without attachable devices is not reported, the runtime would
+// report the network not ready and the kubelet would mark the whole node
+// NotReady, also for the pods that do not request devices, ADD fails for the
+// pods that request them.
+func cmdStatus(args *skel.CmdArgs) error {
+	cfg, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if err := checkHostStateDir(); err != nil {
+		return types.NewError(errPluginNotAvailable, "failed to write the host state of the devices", err.Error())
+	}
+	if cfg.IPAM.Type != "" {
+		return invoke.DelegateStatus(context.TODO(), cfg.IPAM.Type, args.StdinData, nil)
+	}
 	return nil
 }
 
-func moveLinkIn(hostDev netlink.Link, containerNs ns.NetNS, ifName string) (netlink.Link, error) {
+// moveLinksOut moves the devices of the cached states back to the host
+// namespace, they are identified by their pod interface and the host name
+// stored in their alias. Without the cached states nothing is moved, the
+// plugin can not tell its devices from the ones of other plugins.
+func moveLinksOut(containerNs ns.NetNS, states []*hostState) []error {
+	if len(states) == 0 {
+		return nil
+	}
+	// host name by pod interface
+	attached := map[string]string{}
+	for _, state := range states {
+		attached[state.Interface] = state.Name
+	}
+	names := []string{}
+	if err := containerNs.Do(func(_ ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("failed to list the links of the container: %v", err)
+		}
+		for _, link := range links {
+			attrs := link.Attrs()
+			if attrs.Alias == "" || attrs.Alias == attrs.Name {
+				continue
+			}
+			if name, ok := attached[attrs.Name]; ok && name == attrs.Alias {
+				names = append(names, attrs.Name)
+			}
+		}
+		return nil
+	}); err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, name := range names {
+		if err := moveLinkOut(containerNs, name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// moveLinkIn moves the device to the container namespace with the name ifName
+// and applies the MTU, the MAC and the address of the interface of the
+// annotation, the configured link and address are returned.
+func moveLinkIn(hostDev netlink.Link, containerNs ns.NetNS, ifName string, iface Ifreq) (netlink.Link, *netlink.Addr, error) {
+	addr, err := ifreqAddr(iface)
+	if err != nil {
+		return nil, nil, err
+	}
+	var hwAddr net.HardwareAddr
+	if iface.MAC != "" {
+		hwAddr, err = net.ParseMAC(iface.MAC)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse MAC address %q: %v", iface.MAC, err)
+		}
+	}
+
 	if err := netlink.LinkSetNsFd(hostDev, int(containerNs.Fd())); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var contDev netlink.Link
@@ -209,10 +469,26 @@ func moveLinkIn(hostDev netlink.Link, containerNs ns.NetNS, ifName string) (netl
 		if err := netlink.LinkSetAlias(contDev, hostDev.Attrs().Name); err != nil {
 			return fmt.Errorf("failed to set alias to %q: %v", hostDev.Attrs().Name, err)
 		}
-		// Rename container device to respect args.IfName
+		// Rename container device to the pod interface name
 		if err := netlink.LinkSetName(contDev, ifName); err != nil {
 			return fmt.Errorf("failed to rename device %q to %q: %v", hostDev.Attrs().Name, ifName, err)
 		}
+		// Most drivers only change the hardware address while down
+		if hwAddr != nil && !bytes.Equal(contDev.Attrs().HardwareAddr, hwAddr) {
+			if err := netlink.LinkSetHardwareAddr(contDev, hwAddr); err != nil {
+				return fmt.Errorf("failed to set hardware address %s on %q: %v", hwAddr, ifName, err)
+			}
+		}
+		if iface.MTU > 0 {
+			if err := netlink.LinkSetMTU(contDev, iface.MTU); err != nil {
+				return fmt.Errorf("failed to set MTU %d on %q: %v", iface.MTU, ifName, err)
+			}
+		}
+		if addr != nil {
+			if err := netlink.AddrReplace(contDev, addr); err != nil {
+				return fmt.Errorf("failed to add address %s to %q: %v", addr, ifName, err)
+			}
+		}
 		// Bring container device up
 		if err = netlink.LinkSetUp(contDev); err != nil {
 			return fmt.Errorf("failed to set %q up: %v", ifName, err)
@@ -224,10 +500,10 @@ func moveLinkIn(hostDev netlink.Link, containerNs ns.NetNS, ifName string) (netl
 		}
 		return nil
 	}); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return contDev, nil
+	return contDev, addr, nil
 }
 
 func moveLinkOut(containerNs ns.NetNS, ifName string) error {
@@ -271,21 +547,17 @@ func moveLinkOut(containerNs ns.NetNS, ifName string) error {
 	})
 }
 
-func printLink(dev netlink.Link, cniVersion string, containerNs ns.NetNS) error {
-	result := current.Result{
-		CNIVersion: current.ImplementedSpecVersion,
-		Interfaces: []*current.Interface{
-			{
-				Name:    dev.Attrs().Name,
-				Mac:     dev.Attrs().HardwareAddr.String(),
-				Sandbox: containerNs.Path(),
-			},
-		},
-	}
-	return types.PrintResult(&result, cniVersion)
-}
-
+// getLink returns the host device with the name and the hardware address, any
+// of them can be empty
 func getLink(devname, hwaddr string) (netlink.Link, error) {
+	var hwAddr net.HardwareAddr
+	if len(hwaddr) > 0 {
+		var err error
+		hwAddr, err = net.ParseMAC(hwaddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse MAC address %q: %v", hwaddr, err)
+		}
+	}
 	links, err := netlink.LinkList()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list node links: %v", err)
@@ -293,13 +565,15 @@ func getLink(devname, hwaddr string) (netlink.Link, error) {
 	switch {
 
 	case len(devname) > 0:
-		return netlink.LinkByName(devname)
-	case len(hwaddr) > 0:
-		hwAddr, err := net.ParseMAC(hwaddr)
+		link, err := netlink.LinkByName(devname)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse MAC address %q: %v", hwaddr, err)
+			return nil, err
 		}
-
+		if hwAddr != nil && !bytes.Equal(link.Attrs().HardwareAddr, hwAddr) {
+			return nil, fmt.Errorf("device %s has hardware address %s, not %s", devname, link.Attrs().HardwareAddr, hwAddr)
+		}
+		return link, nil
+	case hwAddr != nil:
 		for _, link := range links {
 			if bytes.Equal(link.Attrs().HardwareAddr, hwAddr) {
 				return link, nil
@@ -311,7 +585,13 @@ func getLink(devname, hwaddr string) (netlink.Link, error) {
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("host-device"))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Check:  cmdCheck,
+		Del:    cmdDel,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, bv.BuildString("host-device"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
@@ -368,9 +648,16 @@ func cmdCheck(args *skel.CmdArgs) error {
 			return err
 		}
 
-		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
-		if err != nil {
-			return err
+		// ADD adds the addresses of the devices to the result, each one is
+		// validated on its own interface
+		for i, intf := range result.Interfaces {
+			if intf.Sandbox != args.Netns {
+				continue
+			}
+			err = ip.ValidateExpectedInterfaceIPs(intf.Name, interfaceIPs(result, i))
+			if err != nil {
+				return err
+			}
 		}
 
 		err = ip.ValidateExpectedRoute(result.Routes)
@@ -382,10 +669,129 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return err
 	}
 
-	//
+	// Check the devices requested in the pod annotation
+	kni, ok := cfg.RuntimeConfig.PodAnnotations[NetInterfacesAnnotation]
+	if !ok {
+		return nil
+	}
+	interfaces, err := loadInterfaces([]byte(kni))
+	if err != nil {
+		return err
+	}
+	states, err := loadHostStates(newAttachment(cfg, args))
+	if err != nil {
+		return err
+	}
+	return checkInterfaces(netns, interfaces, states)
+}
+
+// interfaceIPs returns the addresses of the result on the interface with the
+// index
+func interfaceIPs(result *current.Result, index int) []*current.IPConfig {
+	ips := []*current.IPConfig{}
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil && *ipc.Interface == index {
+			ips = append(ips, ipc)
+		}
+	}
+	return ips
+}
+
+// checkInterfaces verifies that the devices of the annotation are attached to
+// the pod with the configuration of the annotation, all the mismatches are
+// reported
+func checkInterfaces(containerNs ns.NetNS, interfaces []Ifreq, states []*hostState) error {
+	var errs []error
+	if err := containerNs.Do(func(_ ns.NetNS) error {
+		for _, iface := range interfaces {
+			state := attachedState(iface, states)
+			if state == nil {
+				errs = append(errs, fmt.Errorf("device %s was not attached to the pod", ifreqID(iface)))
+				continue
+			}
+			errs = append(errs, checkInterface(iface, state)...)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// attachedState returns the cached state of the device of the annotation, the
+// devices found by hardware address had it in the host
+func attachedState(iface Ifreq, states []*hostState) *hostState {
+	for _, state := range states {
+		if iface.Name != "" && state.Name == iface.Name {
+			return state
+		}
+		if iface.Name == "" && sameHardwareAddr(state.HWAddr, iface.HWAddr) {
+			return state
+		}
+	}
 	return nil
 }
 
+// checkInterface returns the differences between the interface in the
+// container namespace and the interface of the annotation
+func checkInterface(iface Ifreq, state *hostState) []error {
+	id := ifreqID(iface)
+	link, err := netlink.LinkByName(state.Interface)
+	if err != nil {
+		return []error{fmt.Errorf("device %s: interface %s not found in the container", id, state.Interface)}
+	}
+	attrs := link.Attrs()
+	var errs []error
+	if attrs.Alias != state.Name {
+		errs = append(errs, fmt.Errorf("device %s: interface %s is the device %q", id, state.Interface, attrs.Alias))
+	}
+	// the device keeps the hardware address it was selected by unless the
+	// MAC is set
+	hwAddr := iface.MAC
+	if hwAddr == "" {
+		hwAddr = iface.HWAddr
+	}
+	if hwAddr != "" && !sameHardwareAddr(attrs.HardwareAddr.String(), hwAddr) {
+		errs = append(errs, fmt.Errorf("device %s: interface %s hardware address %s doesn't match %s", id, state.Interface, attrs.HardwareAddr, hwAddr))
+	}
+	if iface.MTU > 0 && attrs.MTU != iface.MTU {
+		errs = append(errs, fmt.Errorf("device %s: interface %s MTU %d doesn't match %d", id, state.Interface, attrs.MTU, iface.MTU))
+	}
+	if attrs.Flags&net.FlagUp == 0 {
+		errs = append(errs, fmt.Errorf("device %s: interface %s is down", id, state.Interface))
+	}
+	addr, err := ifreqAddr(iface)
+	if err != nil {
+		return append(errs, fmt.Errorf("device %s: %v", id, err))
+	}
+	if addr == nil {
+		return errs
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return append(errs, fmt.Errorf("device %s: failed to list the addresses of interface %s: %v", id, state.Interface, err))
+	}
+	for _, a := range addrs {
+		if a.IPNet.String() == addr.IPNet.String() {
+			return errs
+		}
+	}
+	return append(errs, fmt.Errorf("device %s: interface %s has no address %s", id, state.Interface, addr.IPNet))
+}
+
+// sameHardwareAddr compares the hardware addresses regardless of their format
+func sameHardwareAddr(a, b string) bool {
+	hwA, err := net.ParseMAC(a)
+	if err != nil {
+		return false
+	}
+	hwB, err := net.ParseMAC(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(hwA, hwB)
+}
+
 func validateCniContainerInterface(intf current.Interface) error {
 	var link netlink.Link
 	var err error
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+
+	rspecs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// containerConfigs returns the hook configurations of all the devices of the
+// container, the runtime runs one hook per device but all of them are moved
+// by the first hook so the devices are assigned all together or none. The
+// devices are in the CDI hooks of the runtime configuration, or in the
+// environment of the container when the hook is installed globally, the
+// environment only has the allocation tokens that the plugin recorded.
+func containerConfigs(spec rspecs.Spec, cfg *hookconfig.Config, configPath, sandbox string) ([]*hookconfig.Config, error) {
+	paths := []string{}
+	if spec.Hooks != nil {
+		for _, hook := range spec.Hooks.CreateRuntime {
+			if filepath.Base(hook.Path) != filepath.Base(os.Args[0]) || len(hook.Args) < 2 {
+				continue
+			}
+			flags := flag.NewFlagSet(hook.Path, flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			path := flags.String("config", "", "")
+			flags.String("log", "", "")
+			if err := flags.Parse(hook.Args[1:]); err != nil || *path == "" {
+				continue
+			}
+			paths = append(paths, *path)
+		}
+	}
+	if spec.Process != nil {
+		resolved, err := hookconfig.ResolveConfigs(hookconfig.AllocationDir, spec.Process.Env, sandbox)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, resolved...)
+	}
+
+	configs := []*hookconfig.Config{cfg}
+	seen := map[string]bool{configPath: true}
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if err := hookconfig.ValidConfigPath(path); err != nil {
+			return nil, err
+		}
+		other, err := hookconfig.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, other)
+	}
+	return configs, nil
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	rspecs "github.com/opencontainers/runtime-spec/specs-go"
-	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netns"
+
+	"github.com/aojea/network-device-plugin/pkg/attach"
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/hooklog"
+	"github.com/aojea/network-device-plugin/pkg/pod"
 )
 
 // OCI Hooks
@@ -35,24 +39,26 @@ import (
 // OCI config
 // https://github.com/opencontainers/runtime-spec/blob/main/config.md
 
-// move the network interface passed as argument to the container network namespace
+// move the network interface described in the hook configuration to the container network namespace
 func main() {
 	// Lock the OS Thread so we don't accidentally switch namespaces
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	f, err := os.OpenFile("/var/log/oci.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	var configPath, logOutput string
+	flag.StringVar(&configPath, "config", "", "path to the hook configuration of the device")
+	flag.StringVar(&logOutput, "log", hooklog.OutputFile, "log output, one of "+strings.Join(hooklog.Outputs, ", "))
+	flag.Parse()
+
+	logger := hooklog.New("ifnetns", logOutput)
+	defer logger.Close()
+
+	cfg, err := hookconfig.Load(configPath)
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		logger.Fatal("load configuration", err)
 	}
-	defer f.Close()
-	log.SetOutput(f)
+	logger = logger.With("device", cfg.Device)
 
-	args := os.Args
-	if len(args) != 1 {
-		log.Fatalf("expected only one argument, the name of the interface: %v", args)
-	}
-	ifName := args[0]
 	// Get the network namespace from the runtime configuration
 	var state rspecs.State
 	var spec rspecs.Spec
@@ -60,75 +66,77 @@ func main() {
 	// Get the bundle path from the STATE passed in STDIN
 	data, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		log.Printf("unable to read stdin: %v", err)
-		os.Exit(0)
+		logger.Failure(cfg, hookconfig.FailureState, "read state", err)
+		return
 	}
 	err = json.Unmarshal(data, &state)
 	if err != nil {
-		log.Printf("unable to unmarshal %s: %v", string(data), err)
-		os.Exit(0)
+		logger.Failure(cfg, hookconfig.FailureState, "read state", fmt.Errorf("unable to unmarshal %s: %w", string(data), err))
+		return
 	}
+	sandbox := pod.SandboxID(state.Annotations, state.ID)
+	logger = logger.With("container", state.ID, "sandbox", sandbox)
 	// Get the runtime SPEC
 	config, err := os.ReadFile(filepath.Join(state.Bundle, "config.json"))
 	if err != nil {
-		log.Printf("unable to read OCI spec at %s: %v", state.Bundle, err)
-		os.Exit(0)
+		logger.Failure(cfg, hookconfig.FailureState, "read runtime configuration", err)
+		return
 	}
 	err = json.Unmarshal(config, &spec)
 	if err != nil {
-		log.Printf("unable to unmarshal %s: %v", string(config), err)
-		os.Exit(0)
-	}
-
-	if spec.Linux == nil {
+		logger.Failure(cfg, hookconfig.FailureState, "read runtime configuration", fmt.Errorf("unable to unmarshal OCI spec at %s: %w", state.Bundle, err))
 		return
 	}
-	var nsPath string
-	for _, ns := range spec.Linux.Namespaces {
-		if ns.Type == rspecs.NetworkNamespace {
-			nsPath = ns.Path
-			break
-		}
-	}
-	if nsPath == "" {
-		os.Exit(0)
-	}
 
-	err = linkSetNS(ifName, nsPath)
+	nsPath, err := containerNetNS(state, spec)
 	if err != nil {
-		log.Printf("error moving the interface to the namespaece: %v", err)
-		os.Exit(1)
+		logger.Failure(cfg, hookconfig.FailureAttach, "network namespace", err)
+		return
 	}
-}
 
-func linkSetNS(ifName, nsPath string) error {
-	link, err := netlink.LinkByName(ifName)
-	if err != nil {
-		return err
-	}
-	ns, err := netns.GetFromPath(nsPath)
+	// all the devices of the container are moved by the first hook
+	configs, err := containerConfigs(spec, cfg, configPath, sandbox)
 	if err != nil {
-		return err
+		logger.Failure(cfg, hookconfig.FailureAttach, "load container devices", err)
+		return
 	}
-	defer ns.Close()
-	// Devices can be renamed only when down
-	err = netlink.LinkSetDown(link)
+	// the containers of the pod share the namespace, the devices are
+	// attached once per pod
+	p, err := pod.Open(pod.StateDir, sandbox)
 	if err != nil {
-		return err
+		logger.Failure(cfg, hookconfig.FailureAttach, "open pod state", err)
+		return
 	}
-	// Save host device name into the container device's alias property
-	err = netlink.LinkSetAlias(link, link.Attrs().Name)
+	defer p.Close()
+	err = attach.MoveAll(configs, nsPath, p, state.ID)
 	if err != nil {
-		return fmt.Errorf("fail to set alias for iface %s: %w", ifName, err)
+		logger.Failure(cfg, hookconfig.FailureAttach, "move devices", err)
+		return
 	}
-	err = netlink.LinkSetNsFd(link, int(ns))
-	if err != nil {
-		return fmt.Errorf("fail to move link for iface %s to ns %d : %v", ifName, int(ns), err)
+	logger.Info("devices attached", "step", "move devices", "netns", nsPath, "devices", len(configs))
+}
+
+// containerNetNS returns the path of the container network namespace, the
+// namespace is joined if the runtime configuration has a path or it is a new
+// namespace created by the runtime that can be reached from the container
+// process. Containers without network namespace share the host namespace,
+// moving the interface there would be a no-op so they are refused.
+func containerNetNS(state rspecs.State, spec rspecs.Spec) (string, error) {
+	if spec.Linux == nil {
+		return "", fmt.Errorf("runtime configuration has no linux section")
 	}
-	// This is now inside the container namespace
-	err = netns.Set(ns)
-	if err != nil {
-		return fmt.Errorf("fail to set to ns %d: %v", int(ns), err)
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type != rspecs.NetworkNamespace {
+			continue
+		}
+		if ns.Path != "" {
+			return ns.Path, nil
+		}
+		// the createRuntime hooks run once the container process exists
+		if state.Pid <= 0 {
+			return "", fmt.Errorf("new network namespace without a container process")
+		}
+		return fmt.Sprintf("/proc/%d/ns/net", state.Pid), nil
 	}
-	return nil
+	return "", fmt.Errorf("container uses the host network namespace, network devices can not be assigned to hostNetwork pods")
 }
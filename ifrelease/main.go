@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	rspecs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/aojea/network-device-plugin/pkg/attach"
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/hooklog"
+	"github.com/aojea/network-device-plugin/pkg/pod"
+)
+
+// OCI Hooks
+// https://github.com/opencontainers/runtime-spec/blob/master/config.md#poststop
+
+// Poststop
+// The poststop hooks MUST be called after the container is deleted but before
+// the delete operation returns.
+// The poststop hooks' path MUST resolve in the runtime namespace.
+// The poststop hooks MUST be executed in the runtime namespace.
+
+// OCI state
+// The state of the container MUST be passed to hooks over stdin
+// so that they may do work appropriate to the current state of the container
+// https://github.com/opencontainers/runtime-spec/blob/master/runtime.md#state
+
+// return the network interface described in the hook configuration to the host
+// network namespace once no container of the pod uses it
+func main() {
+	// Lock the OS Thread so we don't accidentally switch namespaces
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var configPath, logOutput string
+	flag.StringVar(&configPath, "config", "", "path to the hook configuration of the device")
+	flag.StringVar(&logOutput, "log", hooklog.OutputFile, "log output, one of "+strings.Join(hooklog.Outputs, ", "))
+	flag.Parse()
+
+	logger := hooklog.New("ifrelease", logOutput)
+	defer logger.Close()
+
+	cfg, err := hookconfig.Load(configPath)
+	if err != nil {
+		logger.Fatal("load configuration", err)
+	}
+	logger = logger.With("device", cfg.Device)
+
+	// Get the container state from STDIN
+	var state rspecs.State
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		logger.Failure(cfg, hookconfig.FailureState, "read state", err)
+		return
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		logger.Failure(cfg, hookconfig.FailureState, "read state", err)
+		return
+	}
+
+	sandbox := pod.SandboxID(state.Annotations, state.ID)
+	logger = logger.With("container", state.ID, "sandbox", sandbox)
+	p, err := pod.Open(pod.StateDir, sandbox)
+	if err != nil {
+		logger.Failure(cfg, hookconfig.FailureState, "open pod state", err)
+		return
+	}
+	defer p.Close()
+
+	attachment := p.Device(cfg.Device)
+	if attachment == nil {
+		logger.Info("device is not attached to the pod")
+		return
+	}
+	// the device stays in the pod while other containers of the pod use it
+	if !p.Detach(cfg.Device, state.ID) {
+		err = p.Save()
+		if err != nil {
+			logger.Failure(cfg, hookconfig.FailureState, "save pod state", err)
+			return
+		}
+		logger.Info("device still used by other containers of the pod", "containers", attachment.Containers)
+		return
+	}
+
+	err = attach.Release(attachment, p.NetNS)
+	if err != nil {
+		// keep the device in the state, it is still attached
+		if serr := p.Save(); serr != nil {
+			logger.Error("can not save the pod state", "step", "save pod state", "error", serr)
+		}
+		logger.Failure(cfg, hookconfig.FailureAttach, "release device", err)
+		return
+	}
+
+	// the plugin watches the state of the pods to know the device is free
+	p.Release(cfg.Device)
+	if len(p.Devices) == 0 {
+		err = p.Delete()
+	} else {
+		err = p.Save()
+	}
+	if err != nil {
+		logger.Failure(cfg, hookconfig.FailureState, "save pod state", err)
+		return
+	}
+	logger.Info("device released", "netns", p.NetNS)
+}
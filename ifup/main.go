@@ -1,11 +1,23 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 
+	rspecs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/vishvananda/netlink"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/hooklog"
+	"github.com/aojea/network-device-plugin/pkg/netconf"
+	"github.com/aojea/network-device-plugin/pkg/pod"
 )
 
 // OCI Hooks
@@ -29,50 +41,124 @@ import (
 // OCI config
 // https://github.com/opencontainers/runtime-spec/blob/main/config.md
 
-// move the network interface passed as argument to the container network namespace
-// the first argument is the interface name and the rest are addresses in netlink.Addr.String() format
+// configure the network interface described in the hook configuration inside the container network namespace
 func main() {
 	// Lock the OS Thread so we don't accidentally switch namespaces
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	f, err := os.OpenFile("/var/log/oci.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	var configPath, logOutput string
+	flag.StringVar(&configPath, "config", "", "path to the hook configuration of the device")
+	flag.StringVar(&logOutput, "log", hooklog.OutputFile, "log output, one of "+strings.Join(hooklog.Outputs, ", "))
+	flag.Parse()
+
+	logger := hooklog.New("ifup", logOutput)
+	defer logger.Close()
+
+	cfg, err := hookconfig.Load(configPath)
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		logger.Fatal("load configuration", err)
 	}
-	defer f.Close()
-	log.SetOutput(f)
+	logger = logger.With("device", cfg.Device)
 
-	args := os.Args
+	// Get the container state from STDIN
+	var state rspecs.State
+	data, err := io.ReadAll(os.Stdin)
+	if err == nil {
+		if err = json.Unmarshal(data, &state); err != nil {
+			err = fmt.Errorf("unable to unmarshal %s: %w", string(data), err)
+		}
+	}
+	hasState := err == nil
+	if !hasState {
+		logger.Failure(cfg, hookconfig.FailureState, "read state", err)
+	}
 
-	if len(args) == 0 {
-		log.Fatalf("expected at least one argument, the name of the interface: %v", args)
+	// the devices are attached once per pod, the interface may have other
+	// name inside the pod and the next containers of the pod find it
+	// already configured
+	var sandbox string
+	var p *pod.Pod
+	var attachment *pod.Attachment
+	if hasState {
+		sandbox = pod.SandboxID(state.Annotations, state.ID)
+		logger = logger.With("container", state.ID, "sandbox", sandbox)
+		p, err = pod.Open(pod.StateDir, sandbox)
+		if err != nil {
+			logger.Failure(cfg, hookconfig.FailureState, "open pod state", err)
+		} else {
+			defer p.Close()
+			attachment = p.Device(cfg.Device)
+		}
+	} else {
+		// without the container there is no pod, the interface is
+		// configured with the name of the configuration and the pod
+		// state is not updated
+		logger.Warn("container state unavailable, skipping the pod state")
+	}
+	if attachment != nil {
+		cfg.Interface = attachment.Interface
+		if attachment.Configured {
+			logger.Info("interface already configured in the pod", "interface", cfg.Interface)
+			return
+		}
 	}
-	ifName := args[0]
+
+	ifName := cfg.Interface
+	logger = logger.With("interface", ifName)
 	link, err := netlink.LinkByName(ifName)
 	if err != nil {
-		log.Fatalf("can not get interface %s by name: %v", ifName, err)
+		logger.Failure(cfg, hookconfig.FailureAttach, "find interface", err)
+		return
 	}
 
-	if len(args) > 1 {
-		for _, addr := range args[1:] {
-			nlAddr, err := netlink.ParseAddr(addr)
-			if err != nil {
-				log.Printf("error parsing address %s: %v", addr, err)
-				continue
-			}
-			err = netlink.AddrAdd(link, nlAddr)
-			if err != nil {
-				log.Printf("error adding address %s: %v", addr, err)
-				continue
-			}
+	// Failure exits if the policy of the class is fail, the configuration
+	// only goes on without the steps the policy allows to fail
+	lease, _ := netconf.Configure(link, cfg, sandbox, containerNetNS(state), func(class, step string, err error) error {
+		logger.Failure(cfg, class, step, err)
+		return nil
+	})
+
+	if lease != nil {
+		err = netconf.StoreLease(lease)
+		if err != nil {
+			logger.Failure(cfg, hookconfig.FailureConfigure, "store lease", err)
 		}
 	}
 
-	// Bring container device up
-	err = netlink.LinkSetUp(link)
-	if err != nil {
-		log.Fatalf("can not set interface %s up: %v", ifName, err)
+	if attachment != nil {
+		attachment.Configured = true
+		err = p.Save()
+		if err != nil {
+			logger.Failure(cfg, hookconfig.FailureConfigure, "save pod state", err)
+		}
 	}
+	logger.Info("interface configured", "addresses", len(cfg.Addresses), "routes", len(cfg.Routes))
+}
 
+// containerNetNS returns the path of the network namespace in the runtime
+// configuration of the container
+func containerNetNS(state rspecs.State) string {
+	if state.Bundle == "" {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(state.Bundle, "config.json"))
+	if err != nil {
+		log.Printf("unable to read OCI spec at %s: %v", state.Bundle, err)
+		return ""
+	}
+	var spec rspecs.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		log.Printf("unable to unmarshal OCI spec at %s: %v", state.Bundle, err)
+		return ""
+	}
+	if spec.Linux == nil {
+		return ""
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == rspecs.NetworkNamespace {
+			return ns.Path
+		}
+	}
+	return ""
 }
@@ -1,5 +1,16 @@
 module main
 
-go 1.22
+go 1.21.4
 
-require github.com/opencontainers/runtime-spec v1.2.0
+require (
+	github.com/aojea/network-device-plugin/pkg v0.0.0
+	github.com/opencontainers/runtime-spec v1.2.0
+)
+
+require (
+	github.com/vishvananda/netlink v1.3.0 // indirect
+	github.com/vishvananda/netns v0.0.4 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
+
+replace github.com/aojea/network-device-plugin/pkg => ../pkg
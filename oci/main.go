@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	rspecs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/hooklog"
+	"github.com/aojea/network-device-plugin/pkg/pod"
 )
 
 // OCI Hooks
@@ -22,6 +31,10 @@ import (
 // The createContainer hooks' path MUST resolve in the runtime namespace.
 // The createContainer hooks MUST be executed in the container namespace.
 
+// Poststop
+// The poststop hooks' path MUST resolve in the runtime namespace.
+// The poststop hooks MUST be executed in the runtime namespace.
+
 // OCI state
 // The state of the container MUST be passed to hooks over stdin
 // so that they may do work appropriate to the current state of the container
@@ -32,51 +45,122 @@ import (
 // OCI config
 // https://github.com/opencontainers/runtime-spec/blob/main/config.md
 
-// move the network interfaces passed to the container network namespace
+// hooks run on each stage of the container lifecycle for the devices
+var stageHooks = map[string]string{
+	"createRuntime":   "ifnetns",
+	"createContainer": "ifup",
+	"poststop":        "ifrelease",
+}
+
+// global hook for the runtimes without CDI support, it runs for all the
+// containers and runs the hook of the stage for the devices the plugin passed
+// in the container environment
 func main() {
 	// Lock the OS Thread so we don't accidentally switch namespaces
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	f, err := os.OpenFile("/var/log/oci-debug.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("error opening file: %v", err)
-	}
-	defer f.Close()
+	var stage, binDir, logOutput string
+	var debug bool
+	flag.StringVar(&stage, "stage", "", "stage of the container lifecycle the hook is installed on: createRuntime, createContainer or poststop")
+	flag.StringVar(&binDir, "bin-dir", "/opt/cdi/bin", "directory with the hooks of the devices")
+	flag.StringVar(&logOutput, "log", hooklog.OutputFile, "log output, one of "+strings.Join(hooklog.Outputs, ", "))
+	flag.BoolVar(&debug, "debug", false, "log the environment, the OCI state and the runtime configuration to /var/log/oci-debug.log")
+	flag.Parse()
 
-	log.SetOutput(f)
+	logger := hooklog.New("oci", logOutput)
+	defer logger.Close()
 
-	log.Printf("ENV: %+v\n", os.Environ())
+	hook, ok := stageHooks[stage]
+	if !ok {
+		logger.Fatal("parse flags", fmt.Errorf("unknown stage %q", stage))
+	}
 
 	// Get the network namespace from the runtime configuration
 	var state rspecs.State
 	var spec rspecs.Spec
 
+	// The hook runs for every container of the node, the containers are not
+	// blocked if it can not tell whether they have devices
 	// Get the bundle path from the STATE passed in STDIN
 	data, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		log.Printf("unable to read stdin: %v", err)
+		logger.Warn("unable to read stdin", "error", err)
 		os.Exit(0)
 	}
-	log.Printf("STDIN: %s\n", string(data))
-
 	err = json.Unmarshal(data, &state)
 	if err != nil {
-		log.Printf("unable to unmarshal %s: %v", string(data), err)
+		logger.Warn("unable to unmarshal the state", "state", string(data), "error", err)
 		os.Exit(0)
 	}
-	log.Printf("STATUS: %+v\n", state)
+	logger = logger.With("container", state.ID, "stage", stage)
 
 	// Get the runtime SPEC
 	config, err := os.ReadFile(filepath.Join(state.Bundle, "config.json"))
 	if err != nil {
-		log.Printf("unable to read OCI spec at %s: %v", state.Bundle, err)
+		logger.Warn("unable to read OCI spec", "bundle", state.Bundle, "error", err)
 		os.Exit(0)
 	}
 	err = json.Unmarshal(config, &spec)
 	if err != nil {
-		log.Printf("unable to unmarshal %s: %v", string(config), err)
+		logger.Warn("unable to unmarshal OCI spec", "bundle", state.Bundle, "error", err)
 		os.Exit(0)
 	}
-	log.Printf("CONFIG: %+v\n", spec)
+
+	if debug {
+		dump(data, state, spec)
+	}
+
+	if spec.Process == nil {
+		return
+	}
+	if len(hookconfig.ConfigTokens(spec.Process.Env)) == 0 {
+		return
+	}
+	// the environment has the allocation tokens of the devices, the paths
+	// of the configurations are only taken from the plugin records
+	sandbox := pod.SandboxID(state.Annotations, state.ID)
+	paths, err := hookconfig.ResolveConfigs(hookconfig.AllocationDir, spec.Process.Env, sandbox)
+	if err != nil {
+		logger.Fatal("resolve devices", err)
+	}
+	// ifnetns moves all the devices of the container at once
+	if hook == "ifnetns" {
+		paths = paths[:1]
+	}
+
+	// the hooks apply the failure policy and report their errors, the
+	// devices are released even if one of them fails
+	failed := false
+	for _, path := range paths {
+		cmd := exec.Command(filepath.Join(binDir, hook), "-config", path, "-log", logOutput)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			logger.Error("hook failed", "hook", hook, "config", path, "error", err)
+			failed = true
+			if hook != "ifrelease" {
+				break
+			}
+		}
+	}
+	if failed {
+		logger.Close()
+		os.Exit(1)
+	}
+}
+
+// dump logs the information passed to the hook, useful for debugging
+func dump(data []byte, state rspecs.State, spec rspecs.Spec) {
+	f, err := os.OpenFile("/var/log/oci-debug.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	l := log.New(f, "", log.LstdFlags)
+	l.Printf("ENV: %+v\n", os.Environ())
+	l.Printf("STDIN: %s\n", string(data))
+	l.Printf("STATUS: %+v\n", state)
+	l.Printf("CONFIG: %+v\n", spec)
 }
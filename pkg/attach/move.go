@@ -0,0 +1,226 @@
+// Package attach moves the network devices between the host and the pod
+// network namespaces, it is used by the hooks and by the plugin when it
+// attaches the devices itself.
+package attach
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/pod"
+)
+
+const (
+	// IFNAMSIZ includes the terminating null byte
+	maxInterfaceNameLen = 15
+	maxInterfaceIndex   = 1000
+)
+
+// steps of the move of a device, the rollback undoes them in reverse order
+const (
+	stepNone = iota
+	stepDown
+	stepAlias
+	stepMoved
+	stepRenamed
+)
+
+// move is the move of a device to the container namespace
+type move struct {
+	cfg *hookconfig.Config
+	// state of the device in the host to restore on rollback
+	host *pod.HostState
+	// last step done
+	step int
+}
+
+// MoveAll moves the devices to the network namespace, if any of them fails the
+// devices moved are returned to the host in the original state. The devices
+// that are already in the namespace, because the devices are attached again when the
+// container restarts or other container of the pod requested them, are left
+// untouched. The devices are recorded in the pod state for the container.
+func MoveAll(configs []*hookconfig.Config, nsPath string, p *pod.Pod, containerID string) error {
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return fmt.Errorf("fail to open network namespace %s: %w", nsPath, err)
+	}
+	defer ns.Close()
+	origin, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("fail to open host network namespace: %w", err)
+	}
+	defer origin.Close()
+	nsHandle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("fail to open netlink socket in namespace %s: %w", nsPath, err)
+	}
+	defer nsHandle.Close()
+
+	done := []*move{}
+	for _, cfg := range configs {
+		cfg.Interface = podInterfaceName(p, nsHandle, cfg)
+		m := &move{cfg: cfg}
+		// undo the partial move too
+		done = append(done, m)
+		if err := m.run(nsHandle, ns); err != nil {
+			err = fmt.Errorf("fail to move device %s to %s as %s: %w", cfg.Device, nsPath, cfg.Interface, err)
+			return rollbackAll(done, nsHandle, origin, err)
+		}
+	}
+
+	p.NetNS = nsPath
+	for _, m := range done {
+		a := p.Attach(m.cfg.Device, m.cfg.Interface, containerID)
+		// the release restores the state of the devices moved now
+		if m.host != nil {
+			a.Host = m.host
+		}
+	}
+	if err := p.Save(); err != nil {
+		// the devices can not be released if they are not recorded
+		err = fmt.Errorf("fail to save the state of pod %s: %w", p.Sandbox, err)
+		return rollbackAll(done, nsHandle, origin, err)
+	}
+	return nil
+}
+
+// rollbackAll undoes the moves in reverse order, the errors of the rollback
+// are added to the error that caused it
+func rollbackAll(done []*move, nsHandle *netlink.Handle, origin netns.NsHandle, err error) error {
+	for i := len(done) - 1; i >= 0; i-- {
+		if rerr := done[i].rollback(nsHandle, origin); rerr != nil {
+			err = errors.Join(err, fmt.Errorf("fail to restore device %s: %w", done[i].cfg.Device, rerr))
+		}
+	}
+	return err
+}
+
+// podInterfaceName returns the name of the device inside the pod, the name in
+// the configuration is used unless other device of the pod already has it,
+// like when several containers of the pod request devices of the same pool.
+func podInterfaceName(p *pod.Pod, nsHandle *netlink.Handle, cfg *hookconfig.Config) string {
+	if a := p.Device(cfg.Device); a != nil {
+		return a.Interface
+	}
+	taken := func(name string) bool {
+		if p.InterfaceInUse(cfg.Device, name) {
+			return true
+		}
+		link, err := nsHandle.LinkByName(name)
+		return err == nil && link.Attrs().Alias != cfg.Device
+	}
+	if !taken(cfg.Interface) {
+		return cfg.Interface
+	}
+	prefix := strings.TrimRight(cfg.Interface, "0123456789")
+	for i := 1; i < maxInterfaceIndex; i++ {
+		name := prefix + strconv.Itoa(i)
+		if len(name) <= maxInterfaceNameLen && !taken(name) {
+			log.Printf("interface %s already used in pod %s, device %s is renamed to %s", cfg.Interface, p.Sandbox, cfg.Device, name)
+			return name
+		}
+	}
+	// the move fails reporting the conflict
+	return cfg.Interface
+}
+
+// run moves the device to the namespace unless it is already there
+func (m *move) run(nsHandle *netlink.Handle, ns netns.NsHandle) error {
+	cfg := m.cfg
+	// already moved and renamed, the alias identifies the host device
+	if link, err := nsHandle.LinkByName(cfg.Interface); err == nil {
+		if link.Attrs().Alias != cfg.Device {
+			return fmt.Errorf("interface %s already exists in the container", cfg.Interface)
+		}
+		log.Printf("device %s already in the container as %s", cfg.Device, cfg.Interface)
+		return nil
+	}
+	// moved but not renamed by a previous attach that did not finish
+	if link, err := nsHandle.LinkByName(cfg.Device); err == nil && link.Attrs().Alias == cfg.Device {
+		log.Printf("device %s already in the container, renaming to %s", cfg.Device, cfg.Interface)
+		return nsHandle.LinkSetName(link, cfg.Interface)
+	}
+
+	link, err := netlink.LinkByName(cfg.Device)
+	if err != nil {
+		return fmt.Errorf("device not found in the host namespace: %w", err)
+	}
+	m.host = pod.NewHostState(link)
+
+	// Devices can be renamed only when down
+	if err := netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("fail to set down: %w", err)
+	}
+	m.step = stepDown
+	// Save host device name into the container device's alias property
+	if err := netlink.LinkSetAlias(link, cfg.Device); err != nil {
+		return fmt.Errorf("fail to set alias: %w", err)
+	}
+	m.step = stepAlias
+	if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		return fmt.Errorf("fail to move to the container namespace: %w", err)
+	}
+	m.step = stepMoved
+	if cfg.Interface == cfg.Device {
+		return nil
+	}
+	// Rename the device inside the container while it is still down, the
+	// host name is in the alias so it can be restored
+	link, err = nsHandle.LinkByName(cfg.Device)
+	if err != nil {
+		return fmt.Errorf("fail to find the device in the container namespace: %w", err)
+	}
+	if err := nsHandle.LinkSetName(link, cfg.Interface); err != nil {
+		return fmt.Errorf("fail to rename: %w", err)
+	}
+	m.step = stepRenamed
+	return nil
+}
+
+// rollback returns the device to the host namespace in its original state
+func (m *move) rollback(nsHandle *netlink.Handle, origin netns.NsHandle) error {
+	cfg := m.cfg
+	if m.step >= stepRenamed {
+		link, err := nsHandle.LinkByName(cfg.Interface)
+		if err != nil {
+			return err
+		}
+		if err := nsHandle.LinkSetName(link, cfg.Device); err != nil {
+			return fmt.Errorf("fail to rename %s back to %s: %w", cfg.Interface, cfg.Device, err)
+		}
+	}
+	if m.step >= stepMoved {
+		link, err := nsHandle.LinkByName(cfg.Device)
+		if err != nil {
+			return err
+		}
+		if err := nsHandle.LinkSetNsFd(link, int(origin)); err != nil {
+			return fmt.Errorf("fail to move back to the host namespace: %w", err)
+		}
+	}
+	if m.step < stepDown {
+		return nil
+	}
+	link, err := netlink.LinkByName(cfg.Device)
+	if err != nil {
+		return err
+	}
+	if m.step >= stepAlias {
+		if err := netlink.LinkSetAlias(link, m.host.Alias); err != nil {
+			return fmt.Errorf("fail to restore alias: %w", err)
+		}
+	}
+	if m.host.Up {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("fail to set up: %w", err)
+		}
+	}
+	return nil
+}
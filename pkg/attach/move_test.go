@@ -0,0 +1,88 @@
+package attach
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/pod"
+)
+
+// podNetNS returns a handle of a new network namespace with the links, the
+// alias of each link is the host device it belongs to
+func podNetNS(t *testing.T, links map[string]string) *netlink.Handle {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create network namespaces")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	if err := netns.Set(origin); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	for name, alias := range links {
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: name},
+			PeerName:  name + "-peer",
+		}
+		if err := h.LinkAdd(veth); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.LinkSetAlias(veth, alias); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+func TestPodInterfaceName(t *testing.T) {
+	h := podNetNS(t, map[string]string{"net2": "eth9", "data1": "eth1"})
+	p := &pod.Pod{
+		Sandbox: "sandbox",
+		Devices: []*pod.Attachment{
+			{Device: "eth5", Interface: "net1"},
+			{Device: "eth6", Interface: "net5"},
+		},
+	}
+	tests := []struct {
+		name     string
+		device   string
+		iface    string
+		expected string
+	}{
+		{name: "free name", device: "eth1", iface: "net3", expected: "net3"},
+		{name: "device already attached", device: "eth6", iface: "net1", expected: "net5"},
+		{name: "name of other device of the pod", device: "eth1", iface: "net1", expected: "net3"},
+		{name: "name of other link of the pod", device: "eth1", iface: "net2", expected: "net3"},
+		{name: "link of the device moved before", device: "eth1", iface: "data1", expected: "data1"},
+		{name: "name without index", device: "eth2", iface: "data1", expected: "data2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &hookconfig.Config{Version: hookconfig.Version, Device: tt.device, Interface: tt.iface}
+			if name := podInterfaceName(p, h, cfg); name != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, name)
+			}
+		})
+	}
+}
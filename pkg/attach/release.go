@@ -0,0 +1,135 @@
+package attach
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/aojea/network-device-plugin/pkg/pod"
+)
+
+// Release moves the device back to the host namespace and restores the state
+// it had before it was attached to the pod
+func Release(a *pod.Attachment, nsPath string) error {
+	link, err := returnToHost(a, nsPath)
+	if err != nil {
+		return err
+	}
+	// destroyed with the namespace or attached by a hook that did not
+	// record the state of the host
+	if link == nil || a.Host == nil {
+		return nil
+	}
+	return restore(link, a.Host)
+}
+
+// returnToHost moves the device from the pod namespace to the host namespace
+// with its host name, the name is stored in the alias of the interface.
+func returnToHost(a *pod.Attachment, nsPath string) (netlink.Link, error) {
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		// the kernel returns the physical devices to the host when the
+		// namespace is destroyed and deletes the virtual ones
+		log.Printf("network namespace %s of device %s is gone: %v", nsPath, a.Device, err)
+		return hostLink(a)
+	}
+	defer ns.Close()
+	origin, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("fail to open host network namespace: %w", err)
+	}
+	defer origin.Close()
+	nsHandle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open netlink socket in namespace %s: %w", nsPath, err)
+	}
+	defer nsHandle.Close()
+
+	link, err := nsHandle.LinkByName(a.Interface)
+	if err != nil || link.Attrs().Alias != a.Device {
+		// a previous release moved it already
+		log.Printf("device %s not found in namespace %s as %s", a.Device, nsPath, a.Interface)
+		return hostLink(a)
+	}
+	// Devices can be renamed only when down
+	if err := nsHandle.LinkSetDown(link); err != nil {
+		return nil, fmt.Errorf("fail to set down %s: %w", a.Interface, err)
+	}
+	if a.Interface != a.Device {
+		if err := nsHandle.LinkSetName(link, a.Device); err != nil {
+			return nil, fmt.Errorf("fail to rename %s back to %s: %w", a.Interface, a.Device, err)
+		}
+	}
+	if err := nsHandle.LinkSetNsFd(link, int(origin)); err != nil {
+		return nil, fmt.Errorf("fail to move %s back to the host namespace: %w", a.Device, err)
+	}
+	return netlink.LinkByName(a.Device)
+}
+
+// hostLink returns the device in the host namespace, the kernel keeps the name
+// the device had in the pod when it returns it, it is renamed to the host name.
+func hostLink(a *pod.Attachment) (netlink.Link, error) {
+	if link, err := netlink.LinkByName(a.Device); err == nil {
+		return link, nil
+	}
+	link, err := netlink.LinkByName(a.Interface)
+	if err != nil || link.Attrs().Alias != a.Device {
+		log.Printf("device %s not found in the host namespace, it was destroyed with the pod", a.Device)
+		return nil, nil
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return nil, fmt.Errorf("fail to set down %s: %w", a.Interface, err)
+	}
+	if err := netlink.LinkSetName(link, a.Device); err != nil {
+		return nil, fmt.Errorf("fail to rename %s back to %s: %w", a.Interface, a.Device, err)
+	}
+	return netlink.LinkByName(a.Device)
+}
+
+// restore undoes the changes of the link profile and restores the alias and
+// the state of the device in the host, the device is down after the move.
+func restore(link netlink.Link, host *pod.HostState) error {
+	attrs := link.Attrs()
+	name := attrs.Name
+	if host.Link.MTU > 0 && attrs.MTU != host.Link.MTU {
+		if err := netlink.LinkSetMTU(link, host.Link.MTU); err != nil {
+			return fmt.Errorf("fail to restore mtu %d on %s: %w", host.Link.MTU, name, err)
+		}
+	}
+	if host.Link.HardwareAddr != "" && attrs.HardwareAddr.String() != host.Link.HardwareAddr {
+		mac, err := net.ParseMAC(host.Link.HardwareAddr)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+			return fmt.Errorf("fail to restore hardware address %s on %s: %w", mac, name, err)
+		}
+	}
+	if host.Link.TxQueueLen > 0 && attrs.TxQLen != host.Link.TxQueueLen {
+		if err := netlink.LinkSetTxQLen(link, host.Link.TxQueueLen); err != nil {
+			return fmt.Errorf("fail to restore txqueuelen %d on %s: %w", host.Link.TxQueueLen, name, err)
+		}
+	}
+	if host.Link.GSOMaxSize > 0 && int(attrs.GSOMaxSize) != host.Link.GSOMaxSize {
+		if err := netlink.LinkSetGSOMaxSize(link, host.Link.GSOMaxSize); err != nil {
+			return fmt.Errorf("fail to restore gso max size %d on %s: %w", host.Link.GSOMaxSize, name, err)
+		}
+	}
+	if host.Link.GROMaxSize > 0 && int(attrs.GROMaxSize) != host.Link.GROMaxSize {
+		if err := netlink.LinkSetGROMaxSize(link, host.Link.GROMaxSize); err != nil {
+			return fmt.Errorf("fail to restore gro max size %d on %s: %w", host.Link.GROMaxSize, name, err)
+		}
+	}
+	if err := netlink.LinkSetAlias(link, host.Alias); err != nil {
+		return fmt.Errorf("fail to restore alias on %s: %w", name, err)
+	}
+	if host.Up {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("fail to set up %s: %w", name, err)
+		}
+	}
+	return nil
+}
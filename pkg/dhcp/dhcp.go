@@ -0,0 +1,461 @@
+// Package dhcp implements the DHCP client used for the interfaces of the pools
+// configured with DHCP.
+//
+// The ifup hook obtains the lease inside the container network namespace and
+// stores it in the lease directory, the hook exits once the container starts
+// so the plugin renews the stored leases entering the namespace of each one.
+package dhcp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/nclient6"
+	"github.com/vishvananda/netlink"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// LeaseDir is the directory of the host where the leases are stored
+const LeaseDir = "/var/run/netdevice/leases"
+
+const (
+	// default timeout of each exchange
+	defaultTimeout = 10 * time.Second
+	// time to wait for the IPv6 link local address, the DHCPv6 client can not
+	// bind its socket until the duplicate address detection finishes
+	linkLocalTimeout = 5 * time.Second
+	// the kernel represents infinite lifetimes with the maximum uint32 value
+	infinite = time.Duration(math.MaxUint32) * time.Second
+)
+
+// Lease is the DHCP state of an interface inside a container namespace, the
+// messages are kept in wire format so they can be used to renew the lease.
+type Lease struct {
+	// NetNS is the path of the container network namespace
+	NetNS string `json:"netns"`
+	// Interface is the name of the interface inside the container
+	Interface string `json:"interface"`
+	// Timeout of each exchange in seconds
+	Timeout int `json:"timeout,omitempty"`
+	// Offer4 and ACK4 are the messages of the last DHCPv4 exchange
+	Offer4 []byte `json:"offer4,omitempty"`
+	ACK4   []byte `json:"ack4,omitempty"`
+	// Reply6 is the reply of the last DHCPv6 exchange
+	Reply6 []byte `json:"reply6,omitempty"`
+	// Acquired is the time of the last exchange, the lifetimes of the
+	// addresses are relative to it
+	Acquired time.Time `json:"acquired"`
+}
+
+// Acquire runs the DHCP exchanges on the interface, it has to run in the
+// network namespace of the interface once the interface is up.
+func Acquire(ctx context.Context, nsPath, ifName string, cfg *hookconfig.DHCP) (*Lease, error) {
+	lease := &Lease{
+		NetNS:     nsPath,
+		Interface: ifName,
+		Timeout:   cfg.Timeout,
+		Acquired:  time.Now(),
+	}
+	if cfg.IPv4 {
+		offer, ack, err := lease.request4(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		lease.Offer4, lease.ACK4 = offer.ToBytes(), ack.ToBytes()
+	}
+	if cfg.IPv6 {
+		reply, err := lease.request6(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		lease.Reply6 = reply.ToBytes()
+	}
+	return lease, nil
+}
+
+// Renew renews the lease, it has to run in the network namespace of the
+// interface. The DHCPv4 lease is renewed with the server that granted it and
+// requested again if the server refuses it, the DHCPv6 exchange is repeated
+// with the same client identifier so the server assigns the same address.
+func (l *Lease) Renew(ctx context.Context) error {
+	now := time.Now()
+	offer, ack, err := l.messages4()
+	if err != nil {
+		return err
+	}
+	if ack != nil {
+		offer, ack, err = l.request4(ctx, &nclient4.Lease{Offer: offer, ACK: ack})
+		if err != nil {
+			return err
+		}
+	}
+	reply, err := l.reply6()
+	if err != nil {
+		return err
+	}
+	if reply != nil {
+		reply, err = l.request6(ctx, reply)
+		if err != nil {
+			return err
+		}
+	}
+	if ack != nil {
+		l.Offer4, l.ACK4 = offer.ToBytes(), ack.ToBytes()
+	}
+	if reply != nil {
+		l.Reply6 = reply.ToBytes()
+	}
+	l.Acquired = now
+	return nil
+}
+
+func (l *Lease) timeout() time.Duration {
+	if l.Timeout > 0 {
+		return time.Duration(l.Timeout) * time.Second
+	}
+	return defaultTimeout
+}
+
+// request4 renews the previous lease if any or runs a full exchange
+func (l *Lease) request4(ctx context.Context, previous *nclient4.Lease) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4, error) {
+	client, err := nclient4.New(l.Interface, nclient4.WithTimeout(l.timeout()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to create DHCPv4 client on %s: %w", l.Interface, err)
+	}
+	defer client.Close()
+
+	options := dhcpv4.WithRequestedOptions(
+		dhcpv4.OptionSubnetMask,
+		dhcpv4.OptionRouter,
+		dhcpv4.OptionClasslessStaticRoute,
+		dhcpv4.OptionInterfaceMTU,
+	)
+	if previous != nil {
+		lease, err := client.Renew(ctx, previous, options)
+		if err == nil {
+			return lease.Offer, lease.ACK, nil
+		}
+		var nak *nclient4.ErrNak
+		if !errors.As(err, &nak) {
+			return nil, nil, fmt.Errorf("fail to renew DHCPv4 lease on %s: %w", l.Interface, err)
+		}
+		// the server does not want to extend the lease, try to get a new one
+	}
+	lease, err := client.Request(ctx, options)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to obtain DHCPv4 lease on %s: %w", l.Interface, err)
+	}
+	return lease.Offer, lease.ACK, nil
+}
+
+// request6 runs the DHCPv6 exchange reusing the client identifier of the
+// previous reply if any
+func (l *Lease) request6(ctx context.Context, previous *dhcpv6.Message) (*dhcpv6.Message, error) {
+	var client *nclient6.Client
+	err := wait(ctx, linkLocalTimeout, func() error {
+		var err error
+		client, err = nclient6.New(l.Interface, nclient6.WithTimeout(l.timeout()))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to create DHCPv6 client on %s: %w", l.Interface, err)
+	}
+	defer client.Close()
+
+	modifiers := []dhcpv6.Modifier{}
+	if previous != nil {
+		if duid := previous.Options.ClientID(); duid != nil {
+			modifiers = append(modifiers, dhcpv6.WithClientID(duid))
+		}
+	}
+	advertise, err := client.Solicit(ctx, modifiers...)
+	if err != nil {
+		return nil, fmt.Errorf("fail to solicit DHCPv6 lease on %s: %w", l.Interface, err)
+	}
+	reply, err := client.Request(ctx, advertise)
+	if err != nil {
+		return nil, fmt.Errorf("fail to obtain DHCPv6 lease on %s: %w", l.Interface, err)
+	}
+	if iana := reply.Options.OneIANA(); iana == nil || len(iana.Options.Addresses()) == 0 {
+		return nil, fmt.Errorf("DHCPv6 server did not assign an address on %s", l.Interface)
+	}
+	return reply, nil
+}
+
+// wait retries the function until it succeeds or the timeout expires
+func wait(ctx context.Context, timeout time.Duration, f func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func (l *Lease) messages4() (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4, error) {
+	if len(l.ACK4) == 0 {
+		return nil, nil, nil
+	}
+	offer, err := dhcpv4.FromBytes(l.Offer4)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid DHCPv4 offer: %w", err)
+	}
+	ack, err := dhcpv4.FromBytes(l.ACK4)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid DHCPv4 ack: %w", err)
+	}
+	return offer, ack, nil
+}
+
+func (l *Lease) reply6() (*dhcpv6.Message, error) {
+	if len(l.Reply6) == 0 {
+		return nil, nil
+	}
+	reply, err := dhcpv6.MessageFromBytes(l.Reply6)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DHCPv6 reply: %w", err)
+	}
+	return reply, nil
+}
+
+// Addrs returns the addresses of the lease with the remaining lifetimes
+func (l *Lease) Addrs() ([]netlink.Addr, error) {
+	addrs := []netlink.Addr{}
+	_, ack, err := l.messages4()
+	if err != nil {
+		return nil, err
+	}
+	if ack != nil {
+		// the subnet mask option is optional, the servers that omit it
+		// assign the classful network of the address
+		mask := ack.SubnetMask()
+		if mask == nil {
+			mask = ack.YourIPAddr.DefaultMask()
+		}
+		if mask == nil {
+			return nil, fmt.Errorf("DHCPv4 lease of address %s has no subnet mask", ack.YourIPAddr)
+		}
+		leaseTime := ack.IPAddressLeaseTime(infinite)
+		addrs = append(addrs, netlink.Addr{
+			IPNet:       &net.IPNet{IP: ack.YourIPAddr, Mask: mask},
+			ValidLft:    l.remaining(leaseTime),
+			PreferedLft: l.remaining(leaseTime),
+		})
+	}
+	reply, err := l.reply6()
+	if err != nil {
+		return nil, err
+	}
+	if reply != nil {
+		iana := reply.Options.OneIANA()
+		if iana == nil {
+			return nil, fmt.Errorf("DHCPv6 reply has no IA_NA option")
+		}
+		for _, addr := range iana.Options.Addresses() {
+			// the prefix is advertised by the routers
+			addrs = append(addrs, netlink.Addr{
+				IPNet:       &net.IPNet{IP: addr.IPv6Addr, Mask: net.CIDRMask(128, 128)},
+				ValidLft:    l.remaining(addr.ValidLifetime),
+				PreferedLft: l.remaining(addr.PreferredLifetime),
+			})
+		}
+	}
+	return addrs, nil
+}
+
+// remaining returns the lifetime left in seconds in the netlink format
+func (l *Lease) remaining(lifetime time.Duration) int {
+	if lifetime >= infinite {
+		return math.MaxUint32
+	}
+	left := lifetime - time.Since(l.Acquired)
+	if left < time.Second {
+		return 0
+	}
+	return int(left.Seconds())
+}
+
+// Routes returns the routes of the DHCPv4 lease, the classless static routes
+// take precedence over the router option as defined in RFC 3442.
+func (l *Lease) Routes() ([]hookconfig.Route, error) {
+	_, ack, err := l.messages4()
+	if err != nil || ack == nil {
+		return nil, err
+	}
+	routes := []hookconfig.Route{}
+	if classless := ack.ClasslessStaticRoute(); len(classless) > 0 {
+		for _, route := range classless {
+			r := hookconfig.Route{Destination: route.Dest.String()}
+			if !route.Router.IsUnspecified() {
+				r.Gateway = route.Router.String()
+			}
+			routes = append(routes, r)
+		}
+		return routes, nil
+	}
+	if routers := ack.Router(); len(routers) > 0 {
+		routes = append(routes, hookconfig.Route{
+			Destination: "0.0.0.0/0",
+			Gateway:     routers[0].String(),
+		})
+	}
+	return routes, nil
+}
+
+// MTU returns the interface MTU option of the DHCPv4 lease, zero if not present
+func (l *Lease) MTU() (int, error) {
+	_, ack, err := l.messages4()
+	if err != nil || ack == nil {
+		return 0, err
+	}
+	mtu, err := dhcpv4.GetUint16(dhcpv4.OptionInterfaceMTU, ack.Options)
+	if err != nil {
+		return 0, nil
+	}
+	return int(mtu), nil
+}
+
+// RenewAt returns the time the lease has to be renewed, T1 of the shortest
+// lease, the zero time if the leases do not expire.
+func (l *Lease) RenewAt() (time.Time, error) {
+	var renew time.Duration
+	_, ack, err := l.messages4()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ack != nil {
+		leaseTime := ack.IPAddressLeaseTime(infinite)
+		if leaseTime < infinite {
+			renew = ack.IPAddressRenewalTime(leaseTime / 2)
+		}
+	}
+	reply, err := l.reply6()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if reply != nil {
+		iana := reply.Options.OneIANA()
+		t1 := iana.T1
+		if t1 == 0 {
+			// the client chooses when the server does not
+			if addr := iana.Options.OneAddress(); addr != nil && addr.PreferredLifetime < infinite {
+				t1 = addr.PreferredLifetime / 2
+			}
+		}
+		if t1 > 0 && t1 < infinite && (renew == 0 || t1 < renew) {
+			renew = t1
+		}
+	}
+	if renew == 0 {
+		return time.Time{}, nil
+	}
+	return l.Acquired.Add(renew), nil
+}
+
+// Apply configures the addresses of the lease on the link, the addresses are
+// replaced so the lifetimes are refreshed after each renewal.
+func (l *Lease) Apply(link netlink.Link) error {
+	addrs, err := l.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		addr := addr
+		if err := netlink.AddrReplace(link, &addr); err != nil {
+			return fmt.Errorf("fail to add address %s to %s: %w", addr.IPNet, l.Interface, err)
+		}
+	}
+	return nil
+}
+
+// fileName returns the name of the lease file, unique per namespace and interface
+func (l *Lease) fileName() string {
+	hash := sha256.Sum256([]byte(l.NetNS))
+	return hex.EncodeToString(hash[:8]) + "-" + l.Interface + ".json"
+}
+
+// Write stores the lease in the directory, the file is replaced atomically
+func (l *Lease) Write(dir string) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+l.fileName())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, l.fileName()))
+}
+
+// Remove deletes the lease from the directory
+func (l *Lease) Remove(dir string) error {
+	err := os.Remove(filepath.Join(dir, l.fileName()))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the leases stored in the directory, the leases that can not be
+// read are reported in the error without discarding the rest.
+func List(dir string) ([]*Lease, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	leases := []*Lease{}
+	var errs []error
+	for _, entry := range entries {
+		// skip the temporary files of the leases being written
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lease := &Lease{}
+		if err := json.Unmarshal(data, lease); err != nil {
+			errs = append(errs, fmt.Errorf("invalid lease %s: %w", entry.Name(), err))
+			continue
+		}
+		leases = append(leases, lease)
+	}
+	return leases, errors.Join(errs...)
+}
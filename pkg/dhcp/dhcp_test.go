@@ -0,0 +1,192 @@
+package dhcp
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+const (
+	serverInterface = "dhcp-server"
+	clientInterface = "dhcp-client"
+)
+
+// pairedNetNS creates a server and a client network namespace connected by a
+// veth pair, the calling thread is locked and left in the host namespace.
+func pairedNetNS(t *testing.T) (server, client netns.NsHandle) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create network namespaces")
+	}
+	runtime.LockOSThread()
+	t.Cleanup(runtime.UnlockOSThread)
+
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { origin.Close() })
+	for _, ns := range []*netns.NsHandle{&server, &client} {
+		*ns, err = netns.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		handle := *ns
+		t.Cleanup(func() { handle.Close() })
+	}
+	if err := netns.Set(origin); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := netns.Set(origin); err != nil {
+			t.Errorf("fail to return to the host namespace: %v", err)
+		}
+	})
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: serverInterface},
+		PeerName:  clientInterface,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	for name, ns := range map[string]netns.NsHandle{serverInterface: server, clientInterface: client} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+			t.Fatal(err)
+		}
+		h, err := netlink.NewHandleAt(ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		if err := h.LinkSetUp(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server, client
+}
+
+// serve runs a DHCPv4 server in the namespace that assigns the address, the
+// subnet mask option is omitted if mask is nil
+func serve(t *testing.T, ns netns.NsHandle, serverIP, ip net.IP, mask net.IPMask) {
+	t.Helper()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	if err := netns.Set(ns); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := netns.Set(origin); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	link, err := netlink.LinkByName(serverInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: serverIP, Mask: net.CIDRMask(24, 32)}}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+		msgType := dhcpv4.MessageTypeOffer
+		if req.MessageType() == dhcpv4.MessageTypeRequest {
+			msgType = dhcpv4.MessageTypeAck
+		}
+		modifiers := []dhcpv4.Modifier{
+			dhcpv4.WithMessageType(msgType),
+			dhcpv4.WithYourIP(ip),
+			dhcpv4.WithServerIP(serverIP),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP)),
+			dhcpv4.WithLeaseTime(3600),
+		}
+		if mask != nil {
+			modifiers = append(modifiers, dhcpv4.WithNetmask(mask))
+		}
+		resp, err := dhcpv4.NewReplyFromRequest(req, modifiers...)
+		if err != nil {
+			t.Errorf("fail to build the reply: %v", err)
+			return
+		}
+		// the client has no address yet
+		dst := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+		if _, err := conn.WriteTo(resp.ToBytes(), dst); err != nil {
+			t.Errorf("fail to send the reply: %v", err)
+		}
+	}
+	// the socket is created in the server namespace
+	server, err := server4.NewServer(serverInterface, &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+}
+
+func TestAcquire(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       net.IP
+		mask     net.IPMask
+		expected string
+	}{
+		{
+			name:     "subnet mask",
+			ip:       net.ParseIP("192.168.100.10"),
+			mask:     net.CIDRMask(24, 32),
+			expected: "192.168.100.10/24",
+		},
+		{
+			name:     "classful mask without subnet mask option",
+			ip:       net.ParseIP("10.1.2.3"),
+			expected: "10.1.2.3/8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := pairedNetNS(t)
+			serverIP := tt.ip.Mask(net.CIDRMask(24, 32))
+			serverIP[len(serverIP)-1] = 1
+			serve(t, server, serverIP, tt.ip, tt.mask)
+
+			if err := netns.Set(client); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			lease, err := Acquire(ctx, "/proc/self/ns/net", clientInterface, &hookconfig.DHCP{IPv4: true, Timeout: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs, err := lease.Addrs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != 1 || addrs[0].IPNet.String() != tt.expected {
+				t.Fatalf("expected address %s, got %v", tt.expected, addrs)
+			}
+			if addrs[0].ValidLft <= 0 || addrs[0].ValidLft > 3600 {
+				t.Errorf("unexpected valid lifetime %d", addrs[0].ValidLft)
+			}
+		})
+	}
+}
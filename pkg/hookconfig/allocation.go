@@ -0,0 +1,204 @@
+package hookconfig
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AllocationDir is the directory where the plugin records the allocations
+// passed in the environment of the containers
+const AllocationDir = "/var/run/netdevice/allocations"
+
+// ConfigDir is the directory of the CDI specs, the plugin writes the hook
+// configurations in a subdirectory named after the spec
+const ConfigDir = "/var/run/cdi"
+
+// Allocation is the record of a device allocated to a container whose
+// devices are passed in the environment. The environment only carries a
+// random token that names the record, any process that can set the
+// environment of a container could otherwise make the hooks load any file
+// of the node or move any device.
+type Allocation struct {
+	Resource string `json:"resource"`
+	Device   string `json:"device"`
+	Config   string `json:"config"`
+	// Sandbox is the pod that claimed the allocation, the token is rejected
+	// for the containers of other pods
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// NewAllocation records the allocation of the device of the resource and
+// returns its token
+func NewAllocation(dir, resource, device, config string) (string, error) {
+	if err := ValidConfigPath(config); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	a := &Allocation{Resource: resource, Device: device, Config: config}
+	if err := writeAllocation(dir, token, a); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// PruneAllocations removes the records of the resource that were not written
+// in the grace period and whose device is not assigned to any pod. The
+// records are kept while the device is assigned, the containers that restart
+// use the same token.
+func PruneAllocations(dir, resource string, assigned func(device string) bool, grace time.Duration) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, entry := range entries {
+		token, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() || strings.HasPrefix(token, ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < grace {
+			continue
+		}
+		a, err := readAllocation(dir, token)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if a.Resource != resource || assigned(a.Device) {
+			continue
+		}
+		if err := RemoveAllocation(dir, token); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RemoveAllocation removes the record of the token
+func RemoveAllocation(dir, token string) error {
+	if err := os.Remove(filepath.Join(dir, token+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ConfigTokens returns the allocation tokens in the environment of the
+// container process, NETDEVICE_<DEVICE>_CONFIG
+func ConfigTokens(env []string) []string {
+	tokens := []string{}
+	for _, e := range env {
+		key, value, ok := strings.Cut(e, "=")
+		if !ok || value == "" || !strings.HasPrefix(key, EnvPrefix) || !strings.HasSuffix(key, ConfigEnvSuffix) {
+			continue
+		}
+		tokens = append(tokens, value)
+	}
+	return tokens
+}
+
+// ResolveConfigs returns the paths of the hook configurations of the tokens
+// in the environment of the container, sorted so all the hooks process them
+// in the same order. The first pod that resolves a token claims it, the
+// hooks of the next containers of the pod resolve it again but the
+// containers of other pods can not.
+func ResolveConfigs(dir string, env []string, sandbox string) ([]string, error) {
+	paths := []string{}
+	for _, token := range ConfigTokens(env) {
+		path, err := claimAllocation(dir, token, sandbox)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// claimAllocation returns the configuration of the allocation of the token
+// and binds the allocation to the pod
+func claimAllocation(dir, token, sandbox string) (string, error) {
+	if _, err := hex.DecodeString(token); err != nil || len(token) != 32 {
+		return "", fmt.Errorf("invalid allocation token %q", token)
+	}
+	a, err := readAllocation(dir, token)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("allocation token %q was not issued by the plugin or the device is no longer assigned", token)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := ValidConfigPath(a.Config); err != nil {
+		return "", err
+	}
+	if a.Sandbox == "" {
+		a.Sandbox = sandbox
+		if err := writeAllocation(dir, token, a); err != nil {
+			return "", err
+		}
+	} else if a.Sandbox != sandbox {
+		return "", fmt.Errorf("allocation of device %s belongs to pod %s", a.Device, a.Sandbox)
+	}
+	return a.Config, nil
+}
+
+// ValidConfigPath checks that the path is a hook configuration written by
+// the plugin in the directory of a CDI spec, /var/run/cdi/<spec>/<device>.json
+func ValidConfigPath(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path ||
+		filepath.Ext(path) != ".json" || filepath.Dir(filepath.Dir(path)) != ConfigDir {
+		return fmt.Errorf("hook config %q is not in a CDI spec directory of %s", path, ConfigDir)
+	}
+	return nil
+}
+
+func readAllocation(dir, token string) (*Allocation, error) {
+	data, err := os.ReadFile(filepath.Join(dir, token+".json"))
+	if err != nil {
+		return nil, err
+	}
+	a := &Allocation{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("invalid allocation %s: %w", token, err)
+	}
+	return a, nil
+}
+
+// writeAllocation replaces the record of the token atomically
+func writeAllocation(dir, token string, a *Allocation) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+token)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, token+".json"))
+}
@@ -0,0 +1,61 @@
+package hookconfig
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveConfigs(t *testing.T) {
+	dir := t.TempDir()
+	config := "/var/run/cdi/netdevice.yaml/eth1.json"
+	token, err := NewAllocation(dir, "networking.k8s.io/netdevice", "eth1", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"PATH=/bin", EnvPrefix + "ETH1" + ConfigEnvSuffix + "=" + token}
+
+	paths, err := ResolveConfigs(dir, env, "pod-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != config {
+		t.Fatalf("expected %s, got %v", config, paths)
+	}
+	// the next containers of the pod resolve the token again
+	if _, err := ResolveConfigs(dir, env, "pod-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveConfigs(dir, env, "pod-b"); err == nil {
+		t.Fatal("expected the token claimed by other pod to be rejected")
+	}
+
+	for _, value := range []string{"/etc/shadow", "0123456789abcdef0123456789abcdef", "../" + token} {
+		env := []string{EnvPrefix + "ETH1" + ConfigEnvSuffix + "=" + value}
+		if _, err := ResolveConfigs(dir, env, "pod-a"); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+
+	if err := PruneAllocations(dir, "networking.k8s.io/netdevice", func(string) bool { return false }, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveConfigs(dir, env, "pod-a"); err == nil {
+		t.Fatal("expected the token of the unassigned device to be rejected")
+	}
+}
+
+func TestValidConfigPath(t *testing.T) {
+	for path, valid := range map[string]bool{
+		"/var/run/cdi/netdevice.yaml/eth1.json":  true,
+		"/var/run/cdi/eth1.json":                 false,
+		"/var/run/cdi/spec/../../../etc/x.json":  false,
+		"/var/run/cdi/spec/dir/eth1.json":        false,
+		"/var/run/cdi/netdevice.yaml/eth1.yaml":  false,
+		"var/run/cdi/netdevice.yaml/eth1.json":   false,
+		"/var/run/netdevice/pods/sandbox/x.json": false,
+	} {
+		if err := ValidConfigPath(path); (err == nil) != valid {
+			t.Errorf("path %s expected valid %v, got error %v", path, valid, err)
+		}
+	}
+}
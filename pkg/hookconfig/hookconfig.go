@@ -0,0 +1,567 @@
+// Package hookconfig defines the configuration document that the plugin writes
+// for each device and the OCI hooks read to know what they have to do with it.
+//
+// The plugin writes the document next to the CDI spec and passes its path in
+// the hook arguments, the document is versioned so hooks built from a
+// different version of the plugin fail with a clear error instead of
+// misinterpreting the configuration.
+package hookconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Version of the configuration document supported by this package
+const Version = "v1alpha1"
+
+// maximum length of an interface name, IFNAMSIZ without the terminating null
+const maxIfNameLen = 15
+
+// Config describes the operations the hooks perform on a network device
+type Config struct {
+	// Version of the document, it must match the Version supported by the hook
+	Version string `json:"version"`
+	// Device is the name of the interface in the host namespace
+	Device string `json:"device"`
+	// Interface is the name of the interface inside the container
+	Interface string `json:"interface"`
+	// Addresses configured on the interface inside the container
+	Addresses []Address `json:"addresses,omitempty"`
+	// Routes installed inside the container once the interface is up
+	Routes []Route `json:"routes,omitempty"`
+	// Table is the routing table used by the interface, if set the routes
+	// without table and the subnet routes of the addresses are installed in
+	// this table, and rules to lookup the table are added for the addresses.
+	Table int `json:"table,omitempty"`
+	// RulePriority is the priority of the source based rules, the kernel
+	// assigns one if not set
+	RulePriority int `json:"rulePriority,omitempty"`
+	// Link settings applied to the interface inside the container, all of
+	// them are mandatory
+	Link *Link `json:"link,omitempty"`
+	// Sysctls applied inside the container namespace before the interface
+	// is up
+	Sysctls []Sysctl `json:"sysctls,omitempty"`
+	// DHCP obtains the addresses, routes and MTU of the interface from a
+	// DHCP server once the interface is up inside the container
+	DHCP *DHCP `json:"dhcp,omitempty"`
+	// DAD configures the duplicate address detection and the announcement of
+	// the addresses once the interface is up, enabled with the default values
+	// if not set
+	DAD *DAD `json:"dad,omitempty"`
+	// Readiness conditions the hook waits for before the container starts
+	Readiness *Readiness `json:"readiness,omitempty"`
+	// FailurePolicy decides which failures abort the container creation
+	FailurePolicy *FailurePolicy `json:"failurePolicy,omitempty"`
+}
+
+// Failure policies, all the hooks apply them the same way
+const (
+	// PolicyFail aborts the container creation, fail closed
+	PolicyFail = "fail"
+	// PolicyWarn logs the failure and lets the container start without the
+	// step that failed, fail open
+	PolicyWarn = "warn"
+)
+
+// Failure classes, the steps of the hooks that can fail
+const (
+	// FailureState is reading the OCI state and the runtime configuration,
+	// and reading or saving the state of the pod
+	FailureState = "state"
+	// FailureAttach is finding the container namespace and moving the device,
+	// into the pod or back to the host
+	FailureAttach = "attach"
+	// FailureConfigure is applying the link profile, sysctls, addresses,
+	// routes and DHCP
+	FailureConfigure = "configure"
+	// FailureAddress is the duplicate address detection and announcement
+	FailureAddress = "address"
+	// FailureReadiness is waiting for the readiness conditions
+	FailureReadiness = "readiness"
+)
+
+// FailurePolicy is the policy of each class of failure, the classes not set
+// use the default policy, that is fail if it is not set either.
+type FailurePolicy struct {
+	Default   string `json:"default,omitempty"`
+	State     string `json:"state,omitempty"`
+	Attach    string `json:"attach,omitempty"`
+	Configure string `json:"configure,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Readiness string `json:"readiness,omitempty"`
+}
+
+// Validate checks the policies
+func (f *FailurePolicy) Validate() error {
+	for class, policy := range map[string]string{
+		"default":        f.Default,
+		FailureState:     f.State,
+		FailureAttach:    f.Attach,
+		FailureConfigure: f.Configure,
+		FailureAddress:   f.Address,
+		FailureReadiness: f.Readiness,
+	} {
+		switch policy {
+		case "", PolicyFail, PolicyWarn:
+		default:
+			return fmt.Errorf("unknown policy %q for %s", policy, class)
+		}
+	}
+	return nil
+}
+
+// Policy returns the policy applied to the class of failure, the policy of
+// the readiness conditions is used for the readiness failures if the failure
+// policy does not set one.
+func (c *Config) Policy(class string) string {
+	var policy, def string
+	if f := c.FailurePolicy; f != nil {
+		def = f.Default
+		switch class {
+		case FailureState:
+			policy = f.State
+		case FailureAttach:
+			policy = f.Attach
+		case FailureConfigure:
+			policy = f.Configure
+		case FailureAddress:
+			policy = f.Address
+		case FailureReadiness:
+			policy = f.Readiness
+		}
+	}
+	if policy == "" && class == FailureReadiness && c.Readiness != nil {
+		policy = c.Readiness.Policy
+	}
+	if policy == "" {
+		policy = def
+	}
+	if policy == "" {
+		policy = PolicyFail
+	}
+	return policy
+}
+
+// Readiness policies applied when the conditions are not met before the timeout
+const (
+	// ReadinessFail fails the hook and the container creation
+	ReadinessFail = "fail"
+	// ReadinessWarn logs the conditions not met and lets the container start
+	ReadinessWarn = "warn"
+)
+
+// Readiness are the conditions the interface has to meet to be usable
+type Readiness struct {
+	// Carrier waits until the link detects the carrier
+	Carrier bool `json:"carrier,omitempty"`
+	// OperState waits until the operational state is up, the devices that
+	// do not report it, like dummy devices, are considered up
+	OperState bool `json:"operState,omitempty"`
+	// DAD waits until none of the addresses of the interface is tentative
+	DAD bool `json:"dad,omitempty"`
+	// Gateway is an address pinged through the interface until it replies
+	Gateway string `json:"gateway,omitempty"`
+	// Timeout in seconds, defaults to 10
+	Timeout int `json:"timeout,omitempty"`
+	// Policy applied on timeout: fail (default) or warn
+	Policy string `json:"policy,omitempty"`
+}
+
+// Validate checks the readiness conditions
+func (r *Readiness) Validate() error {
+	if r.Gateway != "" && net.ParseIP(r.Gateway) == nil {
+		return fmt.Errorf("invalid gateway %q", r.Gateway)
+	}
+	if r.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %d", r.Timeout)
+	}
+	switch r.Policy {
+	case "", ReadinessFail, ReadinessWarn:
+	default:
+		return fmt.Errorf("unknown policy %q", r.Policy)
+	}
+	return nil
+}
+
+// DAD configures the IPv4 address conflict detection (RFC 5227), the wait for
+// the IPv6 duplicate address detection done by the kernel, and the gratuitous
+// ARPs and unsolicited neighbor advertisements sent afterwards. The addresses
+// with the nodad flag are not checked.
+type DAD struct {
+	// Disabled skips the detection and the announcements
+	Disabled bool `json:"disabled,omitempty"`
+	// Probes sent for each IPv4 address, defaults to 3
+	Probes int `json:"probes,omitempty"`
+	// ProbeInterval in milliseconds between probes, it is also the time to
+	// wait for conflicts after the last probe, defaults to 200
+	ProbeInterval int `json:"probeInterval,omitempty"`
+	// Timeout in milliseconds to wait for the IPv6 duplicate address
+	// detection, defaults to 3000
+	Timeout int `json:"timeout,omitempty"`
+	// Announcements sent for each address, defaults to 2
+	Announcements int `json:"announcements,omitempty"`
+}
+
+// Validate checks the duplicate address detection configuration
+func (d *DAD) Validate() error {
+	if d.Probes < 0 || d.ProbeInterval < 0 || d.Timeout < 0 || d.Announcements < 0 {
+		return fmt.Errorf("negative values are not allowed")
+	}
+	return nil
+}
+
+// DHCP enables the DHCP client for the interface, the leases are renewed by
+// the plugin after the hook exits
+type DHCP struct {
+	IPv4 bool `json:"ipv4,omitempty"`
+	IPv6 bool `json:"ipv6,omitempty"`
+	// Timeout of each exchange in seconds, defaults to 10
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Validate checks the DHCP client configuration
+func (d *DHCP) Validate() error {
+	if !d.IPv4 && !d.IPv6 {
+		return fmt.Errorf("at least one of ipv4 or ipv6 has to be enabled")
+	}
+	if d.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %d", d.Timeout)
+	}
+	return nil
+}
+
+// Link is the profile of the interface inside the container
+type Link struct {
+	MTU int `json:"mtu,omitempty"`
+	// HardwareAddr is the MAC address of the interface
+	HardwareAddr string `json:"hardwareAddr,omitempty"`
+	// PodHardwareAddr generates a locally administered MAC address from the
+	// pod sandbox and the interface name, so it is stable across restarts
+	// of the containers of the pod.
+	PodHardwareAddr bool `json:"podHardwareAddr,omitempty"`
+	TxQueueLen      int  `json:"txQueueLen,omitempty"`
+	GSOMaxSize      int  `json:"gsoMaxSize,omitempty"`
+	GROMaxSize      int  `json:"groMaxSize,omitempty"`
+}
+
+// Sysctl is a network sysctl of the container namespace
+type Sysctl struct {
+	// Name of the sysctl in dotted notation, {interface} is replaced by the
+	// name of the interface inside the container, i.e.
+	// net.ipv4.conf.{interface}.rp_filter
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Optional sysctls do not fail the hook if they can not be applied
+	Optional bool `json:"optional,omitempty"`
+}
+
+// Path returns the path of the sysctl under /proc/sys for the interface,
+// the interface is replaced after converting the dots so interface names
+// with dots, like vlans, are not split.
+func (s Sysctl) Path(ifName string) string {
+	name := strings.ReplaceAll(s.Name, ".", "/")
+	name = strings.ReplaceAll(name, "{interface}", ifName)
+	return filepath.Join("/proc/sys", name)
+}
+
+// Validate checks the sysctl can be applied inside the container namespace
+func (s Sysctl) Validate() error {
+	// only the network sysctls are namespaced
+	if !strings.HasPrefix(s.Name, "net.") {
+		return fmt.Errorf("sysctl %q is not a network sysctl", s.Name)
+	}
+	if strings.ContainsAny(s.Name, "/ \t\n") || strings.Contains(s.Name, "..") {
+		return fmt.Errorf("sysctl %q contains invalid characters", s.Name)
+	}
+	if s.Value == "" {
+		return fmt.Errorf("sysctl %q has no value", s.Name)
+	}
+	return nil
+}
+
+// Validate checks the link profile is consistent
+func (l *Link) Validate() error {
+	if l.MTU < 0 || l.TxQueueLen < 0 || l.GSOMaxSize < 0 || l.GROMaxSize < 0 {
+		return fmt.Errorf("negative values are not allowed")
+	}
+	if l.HardwareAddr != "" {
+		if l.PodHardwareAddr {
+			return fmt.Errorf("hardwareAddr and podHardwareAddr are mutually exclusive")
+		}
+		if _, err := net.ParseMAC(l.HardwareAddr); err != nil {
+			return fmt.Errorf("invalid hardware address %q: %w", l.HardwareAddr, err)
+		}
+	}
+	return nil
+}
+
+// Address is an IP address assigned to the interface
+type Address struct {
+	// Address in CIDR format, ip/prefix
+	Address string `json:"address"`
+	// Peer is the address of the other end of point to point interfaces
+	Peer string `json:"peer,omitempty"`
+	// Scope of the address, global if not set
+	Scope string `json:"scope,omitempty"`
+	// Flags of the address, see AddressFlags
+	Flags []string `json:"flags,omitempty"`
+	// ValidLifetime and PreferredLifetime in seconds, the address is
+	// permanent if both are zero
+	ValidLifetime     int `json:"validLifetime,omitempty"`
+	PreferredLifetime int `json:"preferredLifetime,omitempty"`
+}
+
+// AddressFlags are the address flags that can be set from userspace, the
+// rest are managed by the kernel
+var AddressFlags = map[string]int{
+	"nodad":         unix.IFA_F_NODAD,
+	"optimistic":    unix.IFA_F_OPTIMISTIC,
+	"homeaddress":   unix.IFA_F_HOMEADDRESS,
+	"mngtmpaddr":    unix.IFA_F_MANAGETEMPADDR,
+	"noprefixroute": unix.IFA_F_NOPREFIXROUTE,
+}
+
+// AddressScopes are the scopes of the addresses
+var AddressScopes = map[string]int{
+	"global": unix.RT_SCOPE_UNIVERSE,
+	"site":   unix.RT_SCOPE_SITE,
+	"link":   unix.RT_SCOPE_LINK,
+	"host":   unix.RT_SCOPE_HOST,
+}
+
+// HasFlag returns true if the address has the flag set
+func (a Address) HasFlag(flag string) bool {
+	for _, f := range a.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the address is consistent
+func (a Address) Validate() error {
+	ip, _, err := net.ParseCIDR(a.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", a.Address, err)
+	}
+	if a.Peer != "" {
+		peer, _, err := net.ParseCIDR(a.Peer)
+		if err != nil {
+			return fmt.Errorf("invalid peer %q: %w", a.Peer, err)
+		}
+		if (peer.To4() == nil) != (ip.To4() == nil) {
+			return fmt.Errorf("peer %s and address %s belong to different families", a.Peer, a.Address)
+		}
+	}
+	if _, ok := AddressScopes[a.Scope]; a.Scope != "" && !ok {
+		return fmt.Errorf("address %s has unknown scope %q", a.Address, a.Scope)
+	}
+	for _, flag := range a.Flags {
+		if _, ok := AddressFlags[flag]; !ok {
+			return fmt.Errorf("address %s has unknown flag %q", a.Address, flag)
+		}
+	}
+	if a.ValidLifetime < 0 || a.PreferredLifetime < 0 || a.PreferredLifetime > a.ValidLifetime {
+		return fmt.Errorf("address %s has invalid lifetimes valid %d preferred %d", a.Address, a.ValidLifetime, a.PreferredLifetime)
+	}
+	return nil
+}
+
+// Route is a route through the interface
+type Route struct {
+	// Destination in CIDR format, 0.0.0.0/0 or ::/0 for default routes
+	Destination string `json:"destination"`
+	// Gateway address, on-link route if empty
+	Gateway string `json:"gateway,omitempty"`
+	// OnLink sets the onlink flag, the gateway is reachable even if there
+	// is no route to it
+	OnLink bool `json:"onLink,omitempty"`
+	// Metric of the route
+	Metric int `json:"metric,omitempty"`
+	// Table of the route, overrides the table of the interface
+	Table int `json:"table,omitempty"`
+}
+
+// Validate checks the route is consistent
+func (r Route) Validate() error {
+	_, dst, err := net.ParseCIDR(r.Destination)
+	if err != nil {
+		return fmt.Errorf("invalid destination %q: %w", r.Destination, err)
+	}
+	if r.Gateway != "" {
+		gw := net.ParseIP(r.Gateway)
+		if gw == nil {
+			return fmt.Errorf("invalid gateway %q", r.Gateway)
+		}
+		if (gw.To4() == nil) != (dst.IP.To4() == nil) {
+			return fmt.Errorf("gateway %s and destination %s belong to different families", r.Gateway, r.Destination)
+		}
+	} else if r.OnLink {
+		return fmt.Errorf("onLink route to %s requires a gateway", r.Destination)
+	}
+	if r.Metric < 0 {
+		return fmt.Errorf("invalid metric %d", r.Metric)
+	}
+	if r.Table < 0 {
+		return fmt.Errorf("invalid table %d", r.Table)
+	}
+	return nil
+}
+
+// The plugin passes the allocation token of each device in the environment of
+// the container, NETDEVICE_<DEVICE>_CONFIG, when the runtime does not support
+// CDI and a hook installed globally attaches the devices, see Allocation.
+const (
+	EnvPrefix       = "NETDEVICE_"
+	ConfigEnvSuffix = "_CONFIG"
+)
+
+// AnnotationPrefix is the prefix of the container annotations the plugin adds
+// for each device, the runtimes that read the OCI hooks from the hooks.d
+// directories inject the global hook in the containers with them.
+const AnnotationPrefix = "netdevice.networking.k8s.io/"
+
+// Load reads and validates the configuration document, unknown fields are
+// rejected so a hook does not silently ignore something the plugin expects.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read hook config: %w", err)
+	}
+	// check the version first to report the mismatch instead of the fields
+	// that are unknown to this version
+	var header struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("unable to parse hook config %s: %w", path, err)
+	}
+	if header.Version != Version {
+		return nil, fmt.Errorf("hook config %s has version %q but the hook supports version %q, the plugin and the hooks must be installed from the same release", path, header.Version, Version)
+	}
+
+	cfg := &Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse hook config %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid hook config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Write validates and writes the configuration document, the file is replaced
+// atomically so a hook never reads a partial document.
+func (c *Config) Write(path string) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Validate checks the configuration document is consistent
+func (c *Config) Validate() error {
+	if c.Version != Version {
+		return fmt.Errorf("unsupported version %q, expected %q", c.Version, Version)
+	}
+	if err := validateIfName(c.Device); err != nil {
+		return fmt.Errorf("invalid device: %w", err)
+	}
+	if err := validateIfName(c.Interface); err != nil {
+		return fmt.Errorf("invalid interface: %w", err)
+	}
+	for _, addr := range c.Addresses {
+		if err := addr.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, route := range c.Routes {
+		if err := route.Validate(); err != nil {
+			return fmt.Errorf("invalid route: %w", err)
+		}
+	}
+	if c.Table < 0 {
+		return fmt.Errorf("invalid table %d", c.Table)
+	}
+	if c.RulePriority < 0 {
+		return fmt.Errorf("invalid rule priority %d", c.RulePriority)
+	}
+	if c.Link != nil {
+		if err := c.Link.Validate(); err != nil {
+			return fmt.Errorf("invalid link: %w", err)
+		}
+	}
+	for _, sysctl := range c.Sysctls {
+		if err := sysctl.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.DHCP != nil {
+		if err := c.DHCP.Validate(); err != nil {
+			return fmt.Errorf("invalid dhcp: %w", err)
+		}
+	}
+	if c.DAD != nil {
+		if err := c.DAD.Validate(); err != nil {
+			return fmt.Errorf("invalid dad: %w", err)
+		}
+	}
+	if c.Readiness != nil {
+		if err := c.Readiness.Validate(); err != nil {
+			return fmt.Errorf("invalid readiness: %w", err)
+		}
+	}
+	if c.FailurePolicy != nil {
+		if err := c.FailurePolicy.Validate(); err != nil {
+			return fmt.Errorf("invalid failure policy: %w", err)
+		}
+	}
+	return nil
+}
+
+func validateIfName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if len(name) > maxIfNameLen {
+		return fmt.Errorf("name %q longer than %d characters", name, maxIfNameLen)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("name %q contains invalid characters", name)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package hookconfig
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		// substring of the error, empty if the document is valid
+		err string
+	}{
+		{
+			name:     "valid",
+			document: `{"version": "v1alpha1", "device": "eth1", "interface": "net1", "addresses": [{"address": "192.168.1.2/24"}]}`,
+		},
+		{
+			name:     "version mismatch",
+			document: `{"version": "v1beta1", "device": "eth1", "interface": "net1"}`,
+			err:      `has version "v1beta1" but the hook supports version "v1alpha1"`,
+		},
+		{
+			name:     "missing version",
+			document: `{"device": "eth1", "interface": "net1"}`,
+			err:      `has version "" but the hook supports version "v1alpha1"`,
+		},
+		{
+			name:     "version mismatch reported before the unknown fields",
+			document: `{"version": "v1beta1", "device": "eth1", "interface": "net1", "vrf": "blue"}`,
+			err:      `has version "v1beta1"`,
+		},
+		{
+			name:     "unknown field",
+			document: `{"version": "v1alpha1", "device": "eth1", "interface": "net1", "vrf": "blue"}`,
+			err:      `unknown field "vrf"`,
+		},
+		{
+			name:     "unknown nested field",
+			document: `{"version": "v1alpha1", "device": "eth1", "interface": "net1", "addresses": [{"address": "192.168.1.2/24", "label": "x"}]}`,
+			err:      `unknown field "label"`,
+		},
+		{
+			name:     "invalid document",
+			document: `{"version": "v1alpha1",`,
+			err:      "unable to parse hook config",
+		},
+		{
+			name:     "invalid interface",
+			document: `{"version": "v1alpha1", "device": "eth1", "interface": "a-very-long-interface-name"}`,
+			err:      "invalid hook config",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.document), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := Load(path)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if cfg.Device != "eth1" || cfg.Interface != "net1" {
+					t.Fatalf("unexpected config %+v", cfg)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestWriteLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spec", "eth1.json")
+	cfg := &Config{
+		Version:   Version,
+		Device:    "eth1",
+		Interface: "net1",
+		Addresses: []Address{{Address: "2001:db8::2/64", Flags: []string{"nodad"}}},
+		Routes:    []Route{{Destination: "0.0.0.0/0", Gateway: "192.168.1.1"}},
+	}
+	if err := cfg.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Addresses) != 1 || loaded.Addresses[0].Address != "2001:db8::2/64" ||
+		len(loaded.Routes) != 1 || loaded.Routes[0].Gateway != "192.168.1.1" {
+		t.Fatalf("expected %+v, got %+v", cfg, loaded)
+	}
+
+	cfg.Version = "v1beta1"
+	if err := cfg.Write(path); err == nil {
+		t.Fatal("expected the document with other version to be rejected")
+	}
+}
@@ -0,0 +1,111 @@
+// Package hooklog is the logging of the hooks, the records are JSON objects
+// tagged with the hook, the container, the pod sandbox and the device, so the
+// records of the hooks of different containers can be told apart.
+package hooklog
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"path/filepath"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+const (
+	// File is the log file on the host shared by all the hooks
+	File = "/var/log/netdevice/hooks.log"
+	// OutputFile writes the records to File
+	OutputFile = "file"
+	// OutputSyslog writes the records to the syslog socket, journald reads
+	// them on systemd hosts
+	OutputSyslog = "syslog"
+	// OutputStderr writes the records to stderr, the runtime includes them
+	// in the error when the hook fails
+	OutputStderr = "stderr"
+)
+
+// Outputs are the supported log outputs
+var Outputs = []string{OutputFile, OutputSyslog, OutputStderr}
+
+// Logger is the logger of a hook
+type Logger struct {
+	*slog.Logger
+	hook   string
+	closer io.Closer
+}
+
+// New returns the logger of the hook writing to the output, the records are
+// written to stderr if the output can not be opened. It is also the default
+// logger, so the messages of the log package are structured too.
+func New(hook, output string) *Logger {
+	l := &Logger{hook: hook}
+	var w io.Writer
+	var err error
+	switch output {
+	case OutputSyslog:
+		var s *syslog.Writer
+		s, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, hook)
+		w, l.closer = s, s
+	case OutputStderr:
+		w = os.Stderr
+	default:
+		var f *os.File
+		if err = os.MkdirAll(filepath.Dir(File), 0755); err == nil {
+			f, err = os.OpenFile(File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		}
+		w, l.closer = f, f
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: can not open log output %s, using stderr: %v\n", hook, output, err)
+		w, l.closer = os.Stderr, nil
+	}
+	l.Logger = slog.New(slog.NewJSONHandler(w, nil)).With("hook", hook)
+	l.setDefault()
+	return l
+}
+
+func (l *Logger) setDefault() {
+	slog.SetDefault(l.Logger)
+	// the handler adds the time
+	log.SetFlags(0)
+}
+
+// With returns a logger with the attributes added to all the records, like
+// the container, the sandbox or the device.
+func (l *Logger) With(args ...any) *Logger {
+	n := &Logger{Logger: l.Logger.With(args...), hook: l.hook, closer: l.closer}
+	n.setDefault()
+	return n
+}
+
+// Close closes the log output
+func (l *Logger) Close() {
+	if l.closer != nil {
+		l.closer.Close()
+	}
+}
+
+// Fatal logs the error of the step and exits, a concise error is written to
+// stderr so the runtime reports it as the cause of the container failure.
+func (l *Logger) Fatal(step string, err error) {
+	l.Error("hook failed", "step", step, "error", err)
+	fmt.Fprintf(os.Stderr, "%s: %s: %v\n", l.hook, step, err)
+	l.Close()
+	os.Exit(1)
+}
+
+// Failure applies the failure policy of the configuration to the error of the
+// step, the hook exits if the policy of the class is fail, otherwise the
+// failure is logged and the hook goes on without the step.
+func (l *Logger) Failure(cfg *hookconfig.Config, class, step string, err error) {
+	policy := cfg.Policy(class)
+	if policy == hookconfig.PolicyWarn {
+		l.Warn("step failed, ignored by the failure policy", "class", class, "policy", policy, "step", step, "error", err)
+		return
+	}
+	l.With("class", class, "policy", policy).Fatal(step, err)
+}
@@ -0,0 +1,86 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// addAddresses configures the addresses on the interface, the addresses are
+// replaced so the hook can run again on container restarts. The IPv6
+// addresses are skipped if IPv6 is disabled inside the container. All the
+// addresses are tried, the errors of the ones that fail are returned.
+func addAddresses(link netlink.Link, addresses []hookconfig.Address) error {
+	ifName := link.Attrs().Name
+	ipv6 := ipv6Enabled(ifName)
+	var errs []error
+	for _, addr := range addresses {
+		nlAddr, err := netlinkAddr(addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("fail to parse address %s: %w", addr.Address, err))
+			continue
+		}
+		if nlAddr.IP.To4() == nil && !ipv6 {
+			log.Printf("skipping address %s, IPv6 is disabled on interface %s", addr.Address, ifName)
+			continue
+		}
+		err = netlink.AddrReplace(link, nlAddr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("fail to add address %s: %w", addr.Address, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func netlinkAddr(addr hookconfig.Address) (*netlink.Addr, error) {
+	nlAddr, err := netlink.ParseAddr(addr.Address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Peer != "" {
+		nlAddr.Peer, err = netlink.ParseIPNet(addr.Peer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if addr.Scope != "" {
+		scope, ok := hookconfig.AddressScopes[addr.Scope]
+		if !ok {
+			return nil, fmt.Errorf("unknown scope %q", addr.Scope)
+		}
+		nlAddr.Scope = scope
+	}
+	for _, name := range addr.Flags {
+		flag, ok := hookconfig.AddressFlags[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+		nlAddr.Flags |= flag
+	}
+	nlAddr.ValidLft = addr.ValidLifetime
+	nlAddr.PreferedLft = addr.PreferredLifetime
+	return nlAddr, nil
+}
+
+// ipv6Enabled returns false if the kernel has no IPv6 support or IPv6 is
+// disabled on the interface inside the container namespace
+func ipv6Enabled(ifName string) bool {
+	data, err := os.ReadFile("/proc/sys/net/ipv6/conf/" + ifName + "/disable_ipv6")
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == "0"
+}
+
+// isIPv6 returns true if the address or prefix in CIDR format is IPv6
+func isIPv6(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
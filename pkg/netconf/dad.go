@@ -0,0 +1,288 @@
+package netconf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/mdlayher/arp"
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/ndp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+const (
+	defaultProbes        = 3
+	defaultProbeInterval = 200 * time.Millisecond
+	defaultDADTimeout    = 3 * time.Second
+	defaultAnnouncements = 2
+	// interval between announcements and between the checks of the IPv6 DAD
+	announceInterval = 100 * time.Millisecond
+)
+
+// dadConfig returns the configuration with the default values set
+func dadConfig(cfg *hookconfig.Config) hookconfig.DAD {
+	dad := hookconfig.DAD{}
+	if cfg.DAD != nil {
+		dad = *cfg.DAD
+	}
+	if dad.Probes == 0 {
+		dad.Probes = defaultProbes
+	}
+	if dad.ProbeInterval == 0 {
+		dad.ProbeInterval = int(defaultProbeInterval / time.Millisecond)
+	}
+	if dad.Timeout == 0 {
+		dad.Timeout = int(defaultDADTimeout / time.Millisecond)
+	}
+	if dad.Announcements == 0 {
+		dad.Announcements = defaultAnnouncements
+	}
+	return dad
+}
+
+// checkedAddrs returns the IPv4 and IPv6 addresses that have to be checked
+func checkedAddrs(addresses []hookconfig.Address) ([]netip.Addr, []netip.Addr) {
+	var ipv4, ipv6 []netip.Addr
+	for _, addr := range addresses {
+		if addr.HasFlag("nodad") {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(addr.Address)
+		if err != nil {
+			continue
+		}
+		ip := prefix.Addr()
+		if ip.Is4() {
+			ipv4 = append(ipv4, ip)
+		} else if !ip.IsLinkLocalUnicast() {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	return ipv4, ipv6
+}
+
+// hasARP returns true if the link uses ethernet addresses and resolves the
+// neighbors, tunnels and layer 3 devices can not have conflicts on the link
+func hasARP(link netlink.Link) bool {
+	attrs := link.Attrs()
+	return len(attrs.HardwareAddr) == 6 && attrs.RawFlags&unix.IFF_NOARP == 0
+}
+
+// splitProbed returns the addresses that are added before the interface is
+// up and the IPv4 addresses that are probed first. The probes run before the
+// addresses are added (RFC 5227 section 2.1), otherwise the interface answers
+// the ARP requests for the addresses of other hosts while it probes them.
+func splitProbed(link netlink.Link, cfg *hookconfig.Config) ([]hookconfig.Address, []hookconfig.Address) {
+	if dadConfig(cfg).Disabled || !hasARP(link) {
+		return cfg.Addresses, nil
+	}
+	var added, probed []hookconfig.Address
+	for _, addr := range cfg.Addresses {
+		if ipv4, _ := checkedAddrs([]hookconfig.Address{addr}); len(ipv4) > 0 {
+			probed = append(probed, addr)
+		} else {
+			added = append(added, addr)
+		}
+	}
+	return added, probed
+}
+
+// probeAddresses sends ARP probes for the IPv4 addresses, the interface has
+// to be up and the addresses not configured yet. It fails if any address is
+// in use by another host of the link.
+func probeAddresses(link netlink.Link, cfg *hookconfig.Config, addresses []hookconfig.Address) error {
+	ipv4, _ := checkedAddrs(addresses)
+	if len(ipv4) == 0 {
+		return nil
+	}
+	return probeIPv4(link, ipv4, dadConfig(cfg))
+}
+
+// detectDuplicates waits for the kernel to finish the IPv6 duplicate address
+// detection, it fails if any address is in use by another host of the link.
+func detectDuplicates(link netlink.Link, cfg *hookconfig.Config) error {
+	dad := dadConfig(cfg)
+	if dad.Disabled {
+		return nil
+	}
+	_, ipv6 := checkedAddrs(cfg.Addresses)
+	if len(ipv6) > 0 && ipv6Enabled(link.Attrs().Name) {
+		if err := waitIPv6DAD(link, ipv6, time.Duration(dad.Timeout)*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// probeIPv4 sends ARP probes for the addresses, RFC 5227 section 2.1.1
+func probeIPv4(link netlink.Link, ips []netip.Addr, dad hookconfig.DAD) error {
+	ifi, err := net.InterfaceByIndex(link.Attrs().Index)
+	if err != nil {
+		return err
+	}
+	client, err := arp.Dial(ifi)
+	if err != nil {
+		return fmt.Errorf("fail to open ARP socket on %s: %w", ifi.Name, err)
+	}
+	defer client.Close()
+
+	targets := map[netip.Addr]bool{}
+	for _, ip := range ips {
+		targets[ip] = true
+	}
+	zero := net.HardwareAddr{0, 0, 0, 0, 0, 0}
+	interval := time.Duration(dad.ProbeInterval) * time.Millisecond
+	for i := 0; i < dad.Probes; i++ {
+		for _, ip := range ips {
+			probe, err := arp.NewPacket(arp.OperationRequest, ifi.HardwareAddr, netip.IPv4Unspecified(), zero, ip)
+			if err != nil {
+				return err
+			}
+			if err := client.WriteTo(probe, ethernet.Broadcast); err != nil {
+				return fmt.Errorf("fail to send ARP probe for %s: %w", ip, err)
+			}
+		}
+		if err := client.SetReadDeadline(time.Now().Add(interval)); err != nil {
+			return err
+		}
+		for {
+			p, _, err := client.Read()
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				// not an ARP packet
+				continue
+			}
+			if bytes.Equal(p.SenderHardwareAddr, ifi.HardwareAddr) {
+				continue
+			}
+			// another host uses the address or is probing for it
+			if targets[p.SenderIP] {
+				return fmt.Errorf("address %s is already in use by %s", p.SenderIP, p.SenderHardwareAddr)
+			}
+			if p.Operation == arp.OperationRequest && p.SenderIP.IsUnspecified() && targets[p.TargetIP] {
+				return fmt.Errorf("address %s is being probed by %s", p.TargetIP, p.SenderHardwareAddr)
+			}
+		}
+	}
+	return nil
+}
+
+// waitIPv6DAD waits until the kernel finishes the duplicate address
+// detection of the addresses
+func waitIPv6DAD(link netlink.Link, ips []netip.Addr, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return err
+		}
+		tentative := false
+		for _, addr := range addrs {
+			ip, ok := netip.AddrFromSlice(addr.IP)
+			if !ok || !containsAddr(ips, ip.Unmap()) {
+				continue
+			}
+			if addr.Flags&unix.IFA_F_DADFAILED != 0 {
+				return fmt.Errorf("address %s is already in use, duplicate address detection failed", ip)
+			}
+			if addr.Flags&unix.IFA_F_TENTATIVE != 0 {
+				tentative = true
+			}
+		}
+		if !tentative {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for the duplicate address detection on %s", link.Attrs().Name)
+		}
+		time.Sleep(announceInterval)
+	}
+}
+
+func containsAddr(ips []netip.Addr, ip netip.Addr) bool {
+	for _, i := range ips {
+		if i == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// announce sends gratuitous ARPs and unsolicited neighbor advertisements for
+// the addresses, so the neighbors replace the entries that pointed to the
+// interface when it was in the host or to the previous owner of the address.
+func announce(link netlink.Link, cfg *hookconfig.Config) error {
+	dad := dadConfig(cfg)
+	if dad.Disabled || !hasARP(link) {
+		return nil
+	}
+	ifi, err := net.InterfaceByIndex(link.Attrs().Index)
+	if err != nil {
+		return err
+	}
+	ipv4, ipv6 := checkedAddrs(cfg.Addresses)
+	if !ipv6Enabled(ifi.Name) {
+		ipv6 = nil
+	}
+
+	var client *arp.Client
+	if len(ipv4) > 0 {
+		client, err = arp.Dial(ifi)
+		if err != nil {
+			return fmt.Errorf("fail to open ARP socket on %s: %w", ifi.Name, err)
+		}
+		defer client.Close()
+	}
+	conns := map[netip.Addr]*ndp.Conn{}
+	for _, ip := range ipv6 {
+		// the advertisements are sent from the address itself
+		conn, _, err := ndp.Listen(ifi, ndp.Addr(ip.String()))
+		if err != nil {
+			return fmt.Errorf("fail to open NDP socket for %s: %w", ip, err)
+		}
+		defer conn.Close()
+		conns[ip] = conn
+	}
+
+	allNodes := netip.MustParseAddr("ff02::1")
+	zero := net.HardwareAddr{0, 0, 0, 0, 0, 0}
+	for i := 0; i < dad.Announcements; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+		for _, ip := range ipv4 {
+			// RFC 5227 section 2.3, ARP announcement
+			p, err := arp.NewPacket(arp.OperationRequest, ifi.HardwareAddr, ip, zero, ip)
+			if err != nil {
+				return err
+			}
+			if err := client.WriteTo(p, ethernet.Broadcast); err != nil {
+				return fmt.Errorf("fail to send gratuitous ARP for %s: %w", ip, err)
+			}
+		}
+		for ip, conn := range conns {
+			// RFC 4861 section 7.2.6
+			na := &ndp.NeighborAdvertisement{
+				Override:      true,
+				TargetAddress: ip,
+				Options: []ndp.Option{
+					&ndp.LinkLayerAddress{Direction: ndp.Target, Addr: ifi.HardwareAddr},
+				},
+			}
+			if err := conn.WriteTo(na, nil, allNodes); err != nil {
+				return fmt.Errorf("fail to send unsolicited neighbor advertisement for %s: %w", ip, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package netconf
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/aojea/network-device-plugin/pkg/dhcp"
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// configureDHCP obtains the lease of the interface and applies its addresses
+// and MTU, the addresses and routes of the lease are appended to the hook
+// configuration so they are installed with the rest of routes and rules.
+// The lease is returned so it can be stored once the interface is configured.
+func configureDHCP(link netlink.Link, cfg *hookconfig.Config, nsPath string) (*dhcp.Lease, error) {
+	lease, err := dhcp.Acquire(context.Background(), nsPath, cfg.Interface, cfg.DHCP)
+	if err != nil {
+		return nil, err
+	}
+	// the MTU of the link profile takes precedence over the one offered
+	mtu, err := lease.MTU()
+	if err != nil {
+		return nil, err
+	}
+	if mtu > 0 && (cfg.Link == nil || cfg.Link.MTU == 0) {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, fmt.Errorf("fail to set MTU %d: %w", mtu, err)
+		}
+	}
+	if err := lease.Apply(link); err != nil {
+		return nil, err
+	}
+
+	addrs, err := lease.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		cfg.Addresses = append(cfg.Addresses, hookconfig.Address{Address: addr.IPNet.String()})
+	}
+	routes, err := lease.Routes()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Routes = append(cfg.Routes, routes...)
+	return lease, nil
+}
+
+// StoreLease hands the lease over to the plugin, that renews it while the
+// network namespace exists. The plugin can only enter the namespace if it is
+// bind mounted on the host, the namespaces of running processes are not
+// reachable from the plugin pid namespace.
+func StoreLease(lease *dhcp.Lease) error {
+	if lease.NetNS == "" {
+		log.Printf("network namespace of interface %s is not persistent, the lease will not be renewed", lease.Interface)
+		return nil
+	}
+	return lease.Write(dhcp.LeaseDir)
+}
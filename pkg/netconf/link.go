@@ -0,0 +1,85 @@
+package netconf
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// podHardwareAddr generates a locally administered unicast MAC address that
+// is always the same for the same pod and interface
+func podHardwareAddr(sandbox, ifName string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(sandbox + "/" + ifName))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] &^ 0x01) | 0x02
+	return mac
+}
+
+// setLink applies the link profile, it has to be called with the interface
+// down since most of the drivers do not allow to change the MAC address of
+// a running interface
+func setLink(link netlink.Link, profile *hookconfig.Link, sandbox string) error {
+	name := link.Attrs().Name
+	if profile.MTU > 0 {
+		if err := netlink.LinkSetMTU(link, profile.MTU); err != nil {
+			return fmt.Errorf("fail to set mtu %d on %s: %w", profile.MTU, name, err)
+		}
+	}
+
+	var mac net.HardwareAddr
+	if profile.HardwareAddr != "" {
+		var err error
+		mac, err = net.ParseMAC(profile.HardwareAddr)
+		if err != nil {
+			return err
+		}
+	} else if profile.PodHardwareAddr {
+		mac = podHardwareAddr(sandbox, name)
+	}
+	if mac != nil {
+		if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+			return fmt.Errorf("fail to set hardware address %s on %s: %w", mac, name, err)
+		}
+	}
+
+	if profile.TxQueueLen > 0 {
+		if err := netlink.LinkSetTxQLen(link, profile.TxQueueLen); err != nil {
+			return fmt.Errorf("fail to set txqueuelen %d on %s: %w", profile.TxQueueLen, name, err)
+		}
+	}
+	if profile.GSOMaxSize > 0 {
+		if err := netlink.LinkSetGSOMaxSize(link, profile.GSOMaxSize); err != nil {
+			return fmt.Errorf("fail to set gso max size %d on %s: %w", profile.GSOMaxSize, name, err)
+		}
+	}
+	if profile.GROMaxSize > 0 {
+		if err := netlink.LinkSetGROMaxSize(link, profile.GROMaxSize); err != nil {
+			return fmt.Errorf("fail to set gro max size %d on %s: %w", profile.GROMaxSize, name, err)
+		}
+	}
+	return nil
+}
+
+// setSysctls writes the sysctls of the container namespace, the hook runs
+// inside the container network namespace so /proc/sys/net belongs to it
+func setSysctls(ifName string, sysctls []hookconfig.Sysctl) error {
+	for _, sysctl := range sysctls {
+		path := sysctl.Path(ifName)
+		err := os.WriteFile(path, []byte(sysctl.Value), 0644)
+		if err == nil {
+			continue
+		}
+		if sysctl.Optional {
+			log.Printf("can not set optional sysctl %s to %s: %v", path, sysctl.Value, err)
+			continue
+		}
+		return fmt.Errorf("fail to set sysctl %s to %s: %w", path, sysctl.Value, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Package netconf configures the network devices inside the pod network
+// namespace, the link profile, sysctls, addresses, DHCP, routes, duplicate
+// address detection and readiness of the hook configuration. It is used by
+// the ifup hook and by the plugin when it configures the devices itself.
+package netconf
+
+import (
+	"github.com/vishvananda/netlink"
+
+	"github.com/aojea/network-device-plugin/pkg/dhcp"
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// Failure handles the error of a step of the configuration with the failure
+// class of the step, the configuration stops if it returns an error.
+type Failure func(class, step string, err error) error
+
+// Configure configures the interface of the link as described in the
+// configuration, it has to be called from a thread in the network namespace of
+// the pod, nsPath is the path of that namespace used by the DHCP client. The
+// steps that fail are passed to failure, that applies the failure policy. The
+// DHCP lease is returned so it can be stored once the interface is configured.
+func Configure(link netlink.Link, cfg *hookconfig.Config, sandbox, nsPath string, failure Failure) (*dhcp.Lease, error) {
+	ifName := link.Attrs().Name
+	// The link settings are applied while the interface is down
+	if cfg.Link != nil {
+		err := setLink(link, cfg.Link, sandbox)
+		if err != nil {
+			if err := failure(hookconfig.FailureConfigure, "link profile", err); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Sysctls like accept_ra or disable_ipv6 have to be set before the
+	// addresses are added and the interface is up
+	err := setSysctls(ifName, cfg.Sysctls)
+	if err != nil {
+		if err := failure(hookconfig.FailureConfigure, "sysctls", err); err != nil {
+			return nil, err
+		}
+	}
+
+	// The IPv4 addresses that are checked for duplicates are added once the
+	// probes do not find other hosts using them
+	addresses, probed := splitProbed(link, cfg)
+	err = addAddresses(link, addresses)
+	if err != nil {
+		if err := failure(hookconfig.FailureConfigure, "addresses", err); err != nil {
+			return nil, err
+		}
+	}
+
+	// Bring container device up
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		if err := failure(hookconfig.FailureConfigure, "set up", err); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(probed) > 0 {
+		err = probeAddresses(link, cfg, probed)
+		if err != nil {
+			if err := failure(hookconfig.FailureAddress, "duplicate address detection", err); err != nil {
+				return nil, err
+			}
+		}
+		err = addAddresses(link, probed)
+		if err != nil {
+			if err := failure(hookconfig.FailureConfigure, "addresses", err); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The DHCP exchange requires the interface to be up
+	var lease *dhcp.Lease
+	if cfg.DHCP != nil {
+		lease, err = configureDHCP(link, cfg, nsPath)
+		if err != nil {
+			if err := failure(hookconfig.FailureConfigure, "dhcp", err); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The IPv6 addresses are not announced if they are used by other hosts
+	err = detectDuplicates(link, cfg)
+	if err != nil {
+		if err := failure(hookconfig.FailureAddress, "duplicate address detection", err); err != nil {
+			return lease, err
+		}
+	}
+
+	// Routes through a gateway require the interface to be up
+	err = addRoutes(link, cfg)
+	if err != nil {
+		if err := failure(hookconfig.FailureConfigure, "routes", err); err != nil {
+			return lease, err
+		}
+	}
+
+	// Update the neighbors that knew the addresses in the host or in a
+	// previous pod
+	err = announce(link, cfg)
+	if err != nil {
+		if err := failure(hookconfig.FailureAddress, "announce", err); err != nil {
+			return lease, err
+		}
+	}
+
+	// Do not start the container until the interface is usable
+	if cfg.Readiness != nil {
+		err = waitReady(link, cfg.Readiness)
+		if err != nil {
+			if err := failure(hookconfig.FailureReadiness, "readiness", err); err != nil {
+				return lease, err
+			}
+		}
+	}
+	return lease, nil
+}
@@ -0,0 +1,166 @@
+package netconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+const (
+	defaultReadinessTimeout = 10 * time.Second
+	// interval between the checks of the readiness conditions
+	readinessInterval = 100 * time.Millisecond
+	// time to wait for each echo reply of the gateway
+	pingTimeout = time.Second
+)
+
+// waitReady waits until the interface meets the readiness conditions, it
+// returns the conditions that are not met when the timeout expires.
+func waitReady(link netlink.Link, readiness *hookconfig.Readiness) error {
+	timeout := defaultReadinessTimeout
+	if readiness.Timeout > 0 {
+		timeout = time.Duration(readiness.Timeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		pending, err := linkPending(link.Attrs().Index, readiness)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout after %v waiting for %s", timeout, strings.Join(pending, ", "))
+		}
+		time.Sleep(readinessInterval)
+	}
+
+	if readiness.Gateway == "" {
+		return nil
+	}
+	gw := net.ParseIP(readiness.Gateway)
+	for seq := 1; ; seq++ {
+		err := ping(link.Attrs().Name, gw, seq)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout after %v waiting for gateway %s: %w", timeout, gw, err)
+		}
+		// the errors like unreachable networks return immediately
+		time.Sleep(readinessInterval)
+	}
+}
+
+// linkPending returns the conditions of the link that are not met
+func linkPending(index int, readiness *hookconfig.Readiness) ([]string, error) {
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	pending := []string{}
+	attrs := link.Attrs()
+	if readiness.Carrier && attrs.RawFlags&unix.IFF_LOWER_UP == 0 {
+		pending = append(pending, "carrier")
+	}
+	if readiness.OperState && attrs.OperState != netlink.OperUp && attrs.OperState != netlink.OperUnknown {
+		pending = append(pending, "operational state up, current "+attrs.OperState.String())
+	}
+	if readiness.DAD {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if addr.Flags&unix.IFA_F_TENTATIVE != 0 {
+				pending = append(pending, "duplicate address detection of "+addr.IP.String())
+			}
+		}
+	}
+	return pending, nil
+}
+
+// ping sends an ICMP echo request to the address through the interface and
+// waits for the reply, the socket is bound to the interface so the gateway is
+// not reached through other interfaces of the pod.
+func ping(ifName string, ip net.IP, seq int) error {
+	network, address := "ip4:icmp", "0.0.0.0"
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := 1
+	if ip.To4() == nil {
+		network, address = "ip6:ipv6-icmp", "::"
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		proto = 58
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), ifName)
+			}); cerr != nil {
+				return cerr
+			}
+			if err != nil {
+				return fmt.Errorf("fail to bind the ICMP socket to %s: %w", ifName, err)
+			}
+			return nil
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("netdevice")},
+	}
+	data, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	dst := &net.IPAddr{IP: ip}
+	if ip.IsLinkLocalUnicast() {
+		dst.Zone = ifName
+	}
+	if _, err := conn.WriteTo(data, dst); err != nil {
+		return err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(pingTimeout)); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if !peer.(*net.IPAddr).IP.Equal(ip) {
+			continue
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == seq {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package netconf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// addRoutes installs the routes of the interface, if the interface uses its
+// own routing table the subnet routes of the addresses are installed in that
+// table and rules are added so the traffic sourced from the interface
+// addresses uses it, this allows multiple interfaces in overlapping subnets.
+func addRoutes(link netlink.Link, cfg *hookconfig.Config) error {
+	ipv6 := ipv6Enabled(link.Attrs().Name)
+	if cfg.Table != 0 {
+		for _, addr := range cfg.Addresses {
+			ip, subnet, err := net.ParseCIDR(addr.Address)
+			if err != nil {
+				return err
+			}
+			if ip.To4() == nil && !ipv6 {
+				continue
+			}
+			// the kernel only installs the subnet route in the main table
+			ones, bits := subnet.Mask.Size()
+			if ones != bits && !addr.HasFlag("noprefixroute") {
+				route := &netlink.Route{
+					LinkIndex: link.Attrs().Index,
+					Dst:       subnet,
+					Src:       ip,
+					Scope:     netlink.SCOPE_LINK,
+					Table:     cfg.Table,
+				}
+				if err := addRoute(route); err != nil {
+					return fmt.Errorf("fail to add subnet route %s to table %d: %w", subnet, cfg.Table, err)
+				}
+			}
+			if err := addSourceRule(ip, cfg.Table, cfg.RulePriority); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range cfg.Routes {
+		if isIPv6(r.Destination) && !ipv6 {
+			log.Printf("skipping route %s, IPv6 is disabled on interface %s", r.Destination, link.Attrs().Name)
+			continue
+		}
+		route, err := netlinkRoute(link, r)
+		if err != nil {
+			return err
+		}
+		if route.Table == 0 {
+			route.Table = cfg.Table
+		}
+		if err := addRoute(route); err != nil {
+			return fmt.Errorf("fail to add route %s via %q: %w", r.Destination, r.Gateway, err)
+		}
+	}
+	return nil
+}
+
+// addRoute adds the route, the routes of other interfaces are not replaced,
+// like the default route of the primary interface of the pod, the conflict is
+// reported instead. The same route added by a previous run is kept, so the
+// configuration can run again on container restarts.
+func addRoute(route *netlink.Route) error {
+	err := netlink.RouteAdd(route)
+	if err == nil || !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	family := netlink.FAMILY_V4
+	if route.Dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	table := route.Table
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	routes, lerr := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if lerr != nil {
+		return err
+	}
+	for _, r := range routes {
+		// the default routes are listed without destination
+		dst := r.Dst
+		if dst == nil {
+			bits := 8 * len(route.Dst.IP)
+			dst = &net.IPNet{IP: make(net.IP, len(route.Dst.IP)), Mask: net.CIDRMask(0, bits)}
+		}
+		if dst.String() != route.Dst.String() || r.Priority != route.Priority {
+			continue
+		}
+		if r.LinkIndex == route.LinkIndex && r.Gw.Equal(route.Gw) {
+			return nil
+		}
+		return fmt.Errorf("route to %s already exists through other interface or gateway: %w", route.Dst, err)
+	}
+	return err
+}
+
+func netlinkRoute(link netlink.Link, r hookconfig.Route) (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(r.Destination)
+	if err != nil {
+		return nil, err
+	}
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Priority:  r.Metric,
+		Table:     r.Table,
+	}
+	if r.Gateway == "" {
+		// on-link route
+		route.Scope = netlink.SCOPE_LINK
+		return route, nil
+	}
+	route.Gw = net.ParseIP(r.Gateway)
+	if r.OnLink {
+		route.Flags = int(netlink.FLAG_ONLINK)
+	}
+	return route, nil
+}
+
+// addSourceRule adds a rule to lookup the table for the traffic sourced
+// from the ip address, if it does not exist already
+func addSourceRule(ip net.IP, table, priority int) error {
+	family := netlink.FAMILY_V4
+	bits := 32
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+		bits = 128
+	}
+	src := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return fmt.Errorf("fail to list rules: %w", err)
+	}
+	for _, rule := range rules {
+		if rule.Table == table && rule.Src != nil && rule.Src.String() == src.String() {
+			return nil
+		}
+	}
+
+	rule := netlink.NewRule()
+	rule.Src = src
+	rule.Table = table
+	if priority > 0 {
+		rule.Priority = priority
+	}
+	if err := netlink.RuleAdd(rule); err != nil {
+		return fmt.Errorf("fail to add rule from %s lookup %d: %w", src, table, err)
+	}
+	return nil
+}
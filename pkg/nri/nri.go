@@ -0,0 +1,277 @@
+// Package nri attaches the devices from the plugin process using the Node
+// Resource Interface of containerd and CRI-O, no hook runs in the runtime.
+// The devices are found in the container environment, like in the oci hook
+// mode, they are moved to the pod network namespace and configured when the
+// first container that requested them is created and returned to the host
+// when the pod sandbox is stopped.
+package nri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+	rspecs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"k8s.io/klog/v2"
+
+	"github.com/aojea/network-device-plugin/pkg/attach"
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/netconf"
+	"github.com/aojea/network-device-plugin/pkg/pod"
+)
+
+// Plugin handles the events of the pods and containers sent by the runtime
+type Plugin struct {
+	// directories of the pod states and the allocation records
+	stateDir      string
+	allocationDir string
+}
+
+var _ stub.RunPodInterface = &Plugin{}
+var _ stub.StopPodInterface = &Plugin{}
+var _ stub.CreateContainerInterface = &Plugin{}
+var _ stub.SynchronizeInterface = &Plugin{}
+
+// New returns the plugin that keeps the state of the pods in stateDir and
+// resolves the allocation tokens of the containers from allocationDir
+func New(stateDir, allocationDir string) *Plugin {
+	return &Plugin{stateDir: stateDir, allocationDir: allocationDir}
+}
+
+// Synchronize releases the devices of the pods that are gone, the sandboxes
+// may have been stopped while the plugin was not connected.
+func (n *Plugin) Synchronize(ctx context.Context, pods []*api.PodSandbox, containers []*api.Container) ([]*api.ContainerUpdate, error) {
+	running := map[string]bool{}
+	for _, sandbox := range pods {
+		running[sandbox.GetId()] = true
+	}
+	states, err := pod.List(n.stateDir)
+	if err != nil {
+		klog.Infof("fail to read the state of the pods: %v", err)
+	}
+	for _, state := range states {
+		if running[state.Sandbox] {
+			continue
+		}
+		if err := n.releasePod(state.Sandbox); err != nil {
+			klog.Infof("fail to release the devices of pod %s: %v", state.Sandbox, err)
+		}
+	}
+	return nil, nil
+}
+
+// RunPodSandbox only logs the new sandbox, the devices are requested by the
+// containers so they are attached when the containers are created.
+func (n *Plugin) RunPodSandbox(ctx context.Context, sandbox *api.PodSandbox) error {
+	klog.V(4).Infof("pod sandbox %s/%s %s created with network namespace %q", sandbox.GetNamespace(), sandbox.GetName(), sandbox.GetId(), sandboxNetNS(sandbox))
+	return nil
+}
+
+// StopPodSandbox returns the devices of the pod to the host, the containers
+// are stopped and the network namespace still exists.
+func (n *Plugin) StopPodSandbox(ctx context.Context, sandbox *api.PodSandbox) error {
+	if err := n.releasePod(sandbox.GetId()); err != nil {
+		// the runtime ignores the errors of the plugins on stop
+		klog.Infof("fail to release the devices of pod %s/%s: %v", sandbox.GetNamespace(), sandbox.GetName(), err)
+	}
+	return nil
+}
+
+// CreateContainer moves the devices of the container to the pod network
+// namespace and configures them, the failure policy of the devices decides
+// whether the container is created if it fails.
+func (n *Plugin) CreateContainer(ctx context.Context, sandbox *api.PodSandbox, ctr *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+	if len(hookconfig.ConfigTokens(ctr.GetEnv())) == 0 {
+		return nil, nil, nil
+	}
+	// the tokens not issued by the plugin are always refused
+	paths, err := hookconfig.ResolveConfigs(n.allocationDir, ctr.GetEnv(), sandbox.GetId())
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to resolve the devices of container %s in pod %s/%s: %w", ctr.GetName(), sandbox.GetNamespace(), sandbox.GetName(), err)
+	}
+	configs := []*hookconfig.Config{}
+	var errs []error
+	for _, path := range paths {
+		cfg, err := hookconfig.Load(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		configs = append(configs, cfg)
+	}
+	// the configurations that can not be loaded have no policy, the policy
+	// of the first device loaded applies to them as the devices are moved
+	// together, the container fails if none can be loaded
+	if len(errs) > 0 {
+		err := errors.Join(errs...)
+		if len(configs) == 0 {
+			return nil, nil, fmt.Errorf("fail to load the devices of container %s in pod %s/%s: %w", ctr.GetName(), sandbox.GetNamespace(), sandbox.GetName(), err)
+		}
+		if err := nriFailure(configs[0], hookconfig.FailureState, "load configuration", err); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := n.attachContainer(sandbox, ctr.GetId(), configs); err != nil {
+		return nil, nil, fmt.Errorf("fail to attach the devices of container %s in pod %s/%s: %w", ctr.GetName(), sandbox.GetNamespace(), sandbox.GetName(), err)
+	}
+	return nil, nil, nil
+}
+
+// attachContainer attaches the devices to the pod and configures the devices
+// that are not configured yet
+func (n *Plugin) attachContainer(sandbox *api.PodSandbox, containerID string, configs []*hookconfig.Config) error {
+	// all the devices of the container are moved together, the first one
+	// decides the failure policy as it does in the ifnetns hook
+	cfg := configs[0]
+	nsPath := sandboxNetNS(sandbox)
+	if nsPath == "" {
+		return nriFailure(cfg, hookconfig.FailureAttach, "network namespace", fmt.Errorf("pod uses the host network namespace, network devices can not be assigned to hostNetwork pods"))
+	}
+	p, err := pod.Open(n.stateDir, sandbox.GetId())
+	if err != nil {
+		return nriFailure(cfg, hookconfig.FailureAttach, "open pod state", err)
+	}
+	defer p.Close()
+	if err := attach.MoveAll(configs, nsPath, p, containerID); err != nil {
+		return nriFailure(cfg, hookconfig.FailureAttach, "move devices", err)
+	}
+	klog.V(2).Infof("devices of container %s attached to pod %s in %s", containerID, p.Sandbox, nsPath)
+
+	for _, cfg := range configs {
+		a := p.Device(cfg.Device)
+		if a == nil || a.Configured {
+			continue
+		}
+		cfg.Interface = a.Interface
+		configured, err := configureInNetNS(nsPath, cfg, p.Sandbox)
+		if err != nil {
+			return err
+		}
+		a.Configured = configured
+	}
+	if err := p.Save(); err != nil {
+		return nriFailure(cfg, hookconfig.FailureConfigure, "save pod state", err)
+	}
+	return nil
+}
+
+// configureInNetNS configures the interface from a thread in the pod network
+// namespace, it returns false if the interface is not found and the failure
+// policy allows to go on without it. The namespace is entered from a dedicated
+// goroutine, so the thread is discarded when the goroutine exits if it can
+// not return to the host namespace.
+func configureInNetNS(nsPath string, cfg *hookconfig.Config, sandbox string) (bool, error) {
+	type result struct {
+		configured bool
+		err        error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		configured, err := configureInThread(nsPath, cfg, sandbox)
+		ch <- result{configured: configured, err: err}
+	}()
+	r := <-ch
+	return r.configured, r.err
+}
+
+func configureInThread(nsPath string, cfg *hookconfig.Config, sandbox string) (bool, error) {
+	// Lock the OS Thread so we don't accidentally switch namespaces
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return false, fmt.Errorf("fail to open host network namespace: %w", err)
+	}
+	defer origin.Close()
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return false, nriFailure(cfg, hookconfig.FailureAttach, "network namespace", err)
+	}
+	defer ns.Close()
+	if err := netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return false, nriFailure(cfg, hookconfig.FailureAttach, "network namespace", err)
+	}
+	defer func() {
+		// the thread is left locked so it is discarded when the
+		// goroutine exits if it can not return to the host namespace
+		if err := netns.Set(origin); err != nil {
+			klog.Infof("fail to return to the host network namespace: %v", err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+
+	link, err := netlink.LinkByName(cfg.Interface)
+	if err != nil {
+		return false, nriFailure(cfg, hookconfig.FailureAttach, "find interface", err)
+	}
+	lease, err := netconf.Configure(link, cfg, sandbox, nsPath, func(class, step string, err error) error {
+		return nriFailure(cfg, class, step, err)
+	})
+	if err != nil {
+		return false, err
+	}
+	if lease != nil {
+		if err := netconf.StoreLease(lease); err != nil {
+			if err := nriFailure(cfg, hookconfig.FailureConfigure, "store lease", err); err != nil {
+				return false, err
+			}
+		}
+	}
+	klog.V(2).Infof("interface %s of device %s configured in pod %s", cfg.Interface, cfg.Device, sandbox)
+	return true, nil
+}
+
+// nriFailure applies the failure policy of the configuration to the error of
+// the step, the error is returned if the policy of the class is fail.
+func nriFailure(cfg *hookconfig.Config, class, step string, err error) error {
+	policy := cfg.Policy(class)
+	if policy == hookconfig.PolicyWarn {
+		klog.Infof("device %s step %s failed, ignored by the %s failure policy: %v", cfg.Device, step, class, err)
+		return nil
+	}
+	return fmt.Errorf("device %s: %s: %w", cfg.Device, step, err)
+}
+
+// releasePod returns all the devices of the pod to the host and removes the
+// state of the pod, the devices that can not be released are kept in the state.
+func (n *Plugin) releasePod(sandbox string) error {
+	p, err := pod.Open(n.stateDir, sandbox)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	var errs []error
+	for _, a := range p.Devices {
+		if err := attach.Release(a, p.NetNS); err != nil {
+			errs = append(errs, fmt.Errorf("fail to release device %s: %w", a.Device, err))
+			continue
+		}
+		klog.V(2).Infof("device %s released from pod %s", a.Device, sandbox)
+		p.Release(a.Device)
+	}
+	if len(p.Devices) == 0 {
+		err = p.Delete()
+	} else {
+		err = p.Save()
+	}
+	return errors.Join(append(errs, err)...)
+}
+
+// sandboxNetNS returns the path of the network namespace of the pod sandbox,
+// it is empty for the pods that use the host network namespace.
+func sandboxNetNS(sandbox *api.PodSandbox) string {
+	for _, ns := range sandbox.GetLinux().GetNamespaces() {
+		if ns.GetType() == string(rspecs.NetworkNamespace) {
+			return ns.GetPath()
+		}
+	}
+	return ""
+}
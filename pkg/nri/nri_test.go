@@ -0,0 +1,241 @@
+package nri
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/nri/pkg/adaptation"
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+	rspecs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/pod"
+)
+
+// startNRI connects the plugin to a runtime adaptation listening on a
+// temporary socket, the runtime synchronizes the pods passed.
+func startNRI(t *testing.T, n *Plugin, pods []*api.PodSandbox) *adaptation.Adaptation {
+	t.Helper()
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "nri.sock")
+	syncFn := func(ctx context.Context, cb adaptation.SyncCB) error {
+		_, err := cb(ctx, pods, nil)
+		return err
+	}
+	updateFn := func(context.Context, []*adaptation.ContainerUpdate) ([]*adaptation.ContainerUpdate, error) {
+		return nil, nil
+	}
+	r, err := adaptation.New("test", "v0.0.0", syncFn, updateFn,
+		adaptation.WithSocketPath(socket),
+		adaptation.WithPluginPath(filepath.Join(dir, "plugins")),
+		adaptation.WithPluginConfigPath(filepath.Join(dir, "conf.d")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Stop)
+
+	s, err := stub.New(n,
+		stub.WithPluginName("netdevice"),
+		stub.WithPluginIdx("10"),
+		stub.WithSocketPath(socket),
+		stub.WithOnClose(func() {}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return r
+}
+
+// writeHookConfig writes the hook configuration in a CDI spec directory and
+// records its allocation, it returns the environment of the container.
+func writeHookConfig(t *testing.T, allocationDir string, cfg *hookconfig.Config) []string {
+	t.Helper()
+	specDir := filepath.Join(hookconfig.ConfigDir, fmt.Sprintf("netdevice-test-%d", os.Getpid()))
+	if err := os.MkdirAll(specDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(specDir) })
+	path := filepath.Join(specDir, cfg.Device+".json")
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	token, err := hookconfig.NewAllocation(allocationDir, "networking.k8s.io/test", cfg.Device, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []string{configEnv(cfg.Device, token)}
+}
+
+// configEnv returns the environment variable with the allocation token
+func configEnv(device, token string) string {
+	return hookconfig.EnvPrefix + strings.ToUpper(device) + hookconfig.ConfigEnvSuffix + "=" + token
+}
+
+func testSandbox(id, nsPath string) *api.PodSandbox {
+	sandbox := &api.PodSandbox{Id: id, Name: id, Namespace: "default", Linux: &api.LinuxPodSandbox{}}
+	if nsPath != "" {
+		sandbox.Linux.Namespaces = []*api.LinuxNamespace{{Type: string(rspecs.NetworkNamespace), Path: nsPath}}
+	}
+	return sandbox
+}
+
+func TestNRIPlugin(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to move network devices")
+	}
+	n := New(t.TempDir(), t.TempDir())
+
+	// the states of the pods stopped while the plugin was not connected are
+	// released when the runtime synchronizes the plugin
+	for _, sandbox := range []string{"running", "stopped"} {
+		p, err := pod.Open(n.stateDir, sandbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Save(); err != nil {
+			t.Fatal(err)
+		}
+		p.Close()
+	}
+
+	// NewNamed moves the thread to the new namespace
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	nsName := fmt.Sprintf("nri-test-%d", os.Getpid())
+	podNS, err := netns.NewNamed(nsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		podNS.Close()
+		netns.DeleteNamed(nsName)
+	})
+	if err := netns.Set(origin); err != nil {
+		t.Fatal(err)
+	}
+	nsPath := filepath.Join("/var/run/netns", nsName)
+
+	device := "nritest0"
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: device}, PeerName: device + "p"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if link, err := netlink.LinkByName(device); err == nil {
+			netlink.LinkDel(link)
+		}
+	})
+
+	r := startNRI(t, n, []*api.PodSandbox{testSandbox("running", nsPath)})
+	ctx := context.Background()
+	running := testSandbox("running", nsPath)
+
+	// the tokens not issued by the plugin are refused, the plugin may not be
+	// registered yet in the runtime after the synchronization
+	forged := &api.Container{Id: "forged", PodSandboxId: "running", Name: "forged",
+		Env: []string{configEnv(device, filepath.Join(hookconfig.ConfigDir, "spec", device+".json"))}}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := r.CreateContainer(ctx, &adaptation.CreateContainerRequest{Pod: running, Container: forged})
+		if err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the container with a forged token to fail")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(n.stateDir, "stopped.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the state of the stopped pod to be removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(n.stateDir, "running.json")); err != nil {
+		t.Errorf("expected the state of the running pod to be kept: %v", err)
+	}
+
+	// the configuration that can not be loaded fails the container
+	missing, err := hookconfig.NewAllocation(n.allocationDir, "networking.k8s.io/test", "missing", filepath.Join(hookconfig.ConfigDir, "spec", "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctr := &api.Container{Id: "missing", PodSandboxId: "running", Name: "missing", Env: []string{configEnv("missing", missing)}}
+	if _, err := r.CreateContainer(ctx, &adaptation.CreateContainerRequest{Pod: running, Container: ctr}); err == nil {
+		t.Error("expected the container with a missing configuration to fail")
+	}
+
+	// the failure policy of the device decides if the container is created
+	// without the device, the host network pods can not get devices
+	warn := &hookconfig.Config{Version: hookconfig.Version, Device: "nritest1", Interface: "net2",
+		FailurePolicy: &hookconfig.FailurePolicy{Attach: hookconfig.PolicyWarn}}
+	ctr = &api.Container{Id: "warn", PodSandboxId: "host", Name: "warn", Env: writeHookConfig(t, n.allocationDir, warn)}
+	if _, err := r.CreateContainer(ctx, &adaptation.CreateContainerRequest{Pod: testSandbox("host", ""), Container: ctr}); err != nil {
+		t.Errorf("expected the warn policy to ignore the failure: %v", err)
+	}
+
+	cfg := &hookconfig.Config{Version: hookconfig.Version, Device: device, Interface: "net1"}
+	ctr = &api.Container{Id: "app", PodSandboxId: "running", Name: "app", Env: writeHookConfig(t, n.allocationDir, cfg)}
+	if _, err := r.CreateContainer(ctx, &adaptation.CreateContainerRequest{Pod: running, Container: ctr}); err != nil {
+		t.Fatal(err)
+	}
+	h, err := netlink.NewHandleAt(podNS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	link, err := h.LinkByName("net1")
+	if err != nil {
+		t.Fatalf("device not attached to the pod: %v", err)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("interface net1 is not up in the pod")
+	}
+	p, err := pod.Open(n.stateDir, "running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.Device(device)
+	p.Close()
+	if a == nil || !a.Configured {
+		t.Fatalf("expected device %s configured in the pod state, got %+v", device, a)
+	}
+
+	// the devices go back to the host when the pod is stopped
+	if err := r.StopPodSandbox(ctx, &adaptation.StateChangeEvent{Pod: running}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := netlink.LinkByName(device); err != nil {
+		t.Errorf("device not returned to the host: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(n.stateDir, "running.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the state of the stopped pod to be removed: %v", err)
+	}
+}
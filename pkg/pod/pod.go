@@ -0,0 +1,257 @@
+// Package pod tracks the devices attached to each pod sandbox. All the
+// containers of a pod share the network namespace of the sandbox, so the
+// devices are attached once per pod and every container of the pod sees
+// them, including the devices requested by the init containers.
+package pod
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// StateDir is the directory where the hooks store the state of the pods
+const StateDir = "/var/run/netdevice/pods"
+
+// annotations with the pod sandbox ID set by the container runtimes
+var sandboxAnnotations = []string{
+	"io.kubernetes.cri.sandbox-id",  // containerd
+	"io.kubernetes.cri-o.SandboxID", // cri-o
+}
+
+// SandboxID returns the ID of the pod sandbox of the container from the OCI
+// state annotations, or the container ID if the runtime does not provide it
+func SandboxID(annotations map[string]string, containerID string) string {
+	for _, key := range sandboxAnnotations {
+		if id, ok := annotations[key]; ok && id != "" {
+			return id
+		}
+	}
+	return containerID
+}
+
+// Attachment is a device attached to the pod
+type Attachment struct {
+	// Device is the name of the device in the host
+	Device string `json:"device"`
+	// Interface is the name of the device inside the pod, it differs from
+	// the one in the hook configuration if other container of the pod
+	// already uses that name
+	Interface string `json:"interface"`
+	// Containers are the containers of the pod that requested the device
+	Containers []string `json:"containers"`
+	// Host is the state of the device in the host before it was attached,
+	// the release hook restores it
+	Host *HostState `json:"host,omitempty"`
+	// Configured is set once the ifup hook configured the interface, the
+	// next containers of the pod do not configure it again
+	Configured bool `json:"configured,omitempty"`
+}
+
+// HostState is the state of a device in the host namespace
+type HostState struct {
+	Alias string `json:"alias,omitempty"`
+	Up    bool   `json:"up,omitempty"`
+	// Link are the settings the link profile of the pool may change
+	Link hookconfig.Link `json:"link"`
+}
+
+// NewHostState returns the state of the link
+func NewHostState(link netlink.Link) *HostState {
+	attrs := link.Attrs()
+	return &HostState{
+		Alias: attrs.Alias,
+		Up:    attrs.Flags&net.FlagUp != 0,
+		Link: hookconfig.Link{
+			MTU:          attrs.MTU,
+			HardwareAddr: attrs.HardwareAddr.String(),
+			TxQueueLen:   attrs.TxQLen,
+			GSOMaxSize:   int(attrs.GSOMaxSize),
+			GROMaxSize:   int(attrs.GROMaxSize),
+		},
+	}
+}
+
+// Pod is the state of a pod sandbox, it is locked while open so the hooks
+// of the containers of the pod do not overwrite the changes of each other.
+type Pod struct {
+	Sandbox string        `json:"sandbox"`
+	NetNS   string        `json:"netns,omitempty"`
+	Devices []*Attachment `json:"devices"`
+
+	dir  string
+	lock *os.File
+}
+
+// Open locks and loads the state of the pod sandbox, a new state is returned
+// if the pod has no devices attached yet.
+func Open(dir, sandbox string) (*Pod, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, sandbox+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("fail to lock the state of pod %s: %w", sandbox, err)
+	}
+	p := &Pod{Sandbox: sandbox, dir: dir, lock: lock}
+	data, err := os.ReadFile(p.file())
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, p)
+	}
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("invalid state of pod %s: %w", sandbox, err)
+	}
+	return p, nil
+}
+
+// Close releases the lock of the pod state
+func (p *Pod) Close() error {
+	return p.lock.Close()
+}
+
+func (p *Pod) file() string {
+	return filepath.Join(p.dir, p.Sandbox+".json")
+}
+
+// Save writes the state of the pod replacing the previous one atomically
+func (p *Pod) Save() error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(p.dir, "."+p.Sandbox)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.file())
+}
+
+// Device returns the attachment of the device or nil if it is not attached
+func (p *Pod) Device(device string) *Attachment {
+	for _, a := range p.Devices {
+		if a.Device == device {
+			return a
+		}
+	}
+	return nil
+}
+
+// InterfaceInUse returns true if other device of the pod has the name
+func (p *Pod) InterfaceInUse(device, ifName string) bool {
+	for _, a := range p.Devices {
+		if a.Device != device && a.Interface == ifName {
+			return true
+		}
+	}
+	return false
+}
+
+// Attach records the device as attached to the pod for the container
+func (p *Pod) Attach(device, ifName, container string) *Attachment {
+	a := p.Device(device)
+	if a == nil {
+		a = &Attachment{Device: device, Interface: ifName}
+		p.Devices = append(p.Devices, a)
+	}
+	for _, c := range a.Containers {
+		if c == container {
+			return a
+		}
+	}
+	a.Containers = append(a.Containers, container)
+	return a
+}
+
+// Detach removes the container from the containers that requested the device
+// and returns true if no other container of the pod requested it
+func (p *Pod) Detach(device, container string) bool {
+	a := p.Device(device)
+	if a == nil {
+		return true
+	}
+	containers := []string{}
+	for _, c := range a.Containers {
+		if c != container {
+			containers = append(containers, c)
+		}
+	}
+	a.Containers = containers
+	return len(containers) == 0
+}
+
+// Release removes the device from the pod
+func (p *Pod) Release(device string) {
+	devices := []*Attachment{}
+	for _, a := range p.Devices {
+		if a.Device != device {
+			devices = append(devices, a)
+		}
+	}
+	p.Devices = devices
+}
+
+// Delete removes the state of the pod, it is used once the pod has no
+// devices, the lock is removed too since no other hook of the pod runs.
+func (p *Pod) Delete() error {
+	if err := os.Remove(p.file()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(p.lock.Name())
+}
+
+// List returns the state of the pods stored in the directory, without
+// locking them, the errors of the invalid states are joined.
+func List(dir string) ([]*Pod, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	pods := []*Pod{}
+	var errs []error
+	for _, entry := range entries {
+		// skip the locks and the temporary files of the states being written
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p := &Pod{dir: dir}
+		if err := json.Unmarshal(data, p); err != nil {
+			errs = append(errs, fmt.Errorf("invalid pod state %s: %w", entry.Name(), err))
+			continue
+		}
+		pods = append(pods, p)
+	}
+	return pods, errors.Join(errs...)
+}
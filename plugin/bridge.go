@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// hostEndName returns the name of the end of the pair that stays in the host
+// namespace attached to the bridge.
+func hostEndName(name string) string {
+	return name + "-h"
+}
+
+// createPair creates a veth or netkit pair, the end named as the device is
+// moved to the pod by the hooks and the other end is attached to the bridge.
+func createPair(pool poolConfig, name string) error {
+	bridge, err := netlink.LinkByName(pool.Bridge.Name)
+	if err != nil {
+		return fmt.Errorf("fail to get bridge %s: %w", pool.Bridge.Name, err)
+	}
+
+	hostAttrs := netlink.NewLinkAttrs()
+	hostAttrs.Name = hostEndName(name)
+	hostAttrs.MTU = pool.Bridge.MTU
+	podAttrs := netlink.NewLinkAttrs()
+	podAttrs.Name = name
+	podAttrs.MTU = pool.Bridge.MTU
+
+	var link netlink.Link
+	if pool.Bridge.Netkit {
+		netkit := &netlink.Netkit{
+			LinkAttrs: hostAttrs,
+			// the bridge needs ethernet frames
+			Mode:       netlink.NETKIT_MODE_L2,
+			Policy:     netlink.NETKIT_POLICY_FORWARD,
+			PeerPolicy: netlink.NETKIT_POLICY_FORWARD,
+		}
+		netkit.SetPeerAttrs(&podAttrs)
+		err = netlink.LinkAdd(netkit)
+		if err == nil {
+			link = netkit
+		} else if errors.Is(err, unix.EOPNOTSUPP) {
+			klog.Infof("netkit not supported by the kernel, using veth for device %s", name)
+		} else {
+			return fmt.Errorf("fail to create netkit pair %s: %w", name, err)
+		}
+	}
+	if link == nil {
+		veth := &netlink.Veth{
+			LinkAttrs: hostAttrs,
+			PeerName:  name,
+		}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return fmt.Errorf("fail to create veth pair %s: %w", name, err)
+		}
+		link = veth
+	}
+
+	// deleting one end of the pair deletes both
+	if err := markLinks(pool.Name, hostAttrs.Name, name); err != nil {
+		_ = netlink.LinkDel(link)
+		return err
+	}
+	if err := netlink.LinkSetMaster(link, bridge); err != nil {
+		_ = netlink.LinkDel(link)
+		return fmt.Errorf("fail to attach %s to bridge %s: %w", hostAttrs.Name, pool.Bridge.Name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		_ = netlink.LinkDel(link)
+		return fmt.Errorf("fail to set %s up: %w", hostAttrs.Name, err)
+	}
+	return nil
+}
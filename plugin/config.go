@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// Device pool modes
+const (
+	// host moves existing host interfaces matching a regex into the pods
+	modeHost = "host"
+	// tunnel modes create a dedicated tunnel device on each allocation
+	modeVxlan     = "vxlan"
+	modeGeneve    = "geneve"
+	modeWireguard = "wireguard"
+	// bridge mode creates a veth or netkit pair attached to a bridge on each allocation
+	modeBridge = "bridge"
+)
+
+const (
+	// default template of the interface names inside the container
+	defaultInterfaceName = "net{index}"
+	// maximum length of an interface name, IFNAMSIZ without the terminating null
+	maxIfNameLen = 15
+	// VNIs are 24 bits long
+	maxVNI = 1<<24 - 1
+)
+
+// config is the plugin configuration file, each pool is advertised to the
+// kubelet as a different extended resource.
+type config struct {
+	Pools []poolConfig `json:"pools"`
+}
+
+// poolConfig describes a set of network devices that can be allocated to pods
+type poolConfig struct {
+	// Name of the pool, it is used for the plugin socket and as prefix of the
+	// virtual devices created by the pool.
+	Name string `json:"name"`
+	// ResourceName advertised to the kubelet, defaults to networking.k8s.io/<name>
+	ResourceName string `json:"resourceName,omitempty"`
+	// Mode of the pool: host (default), vxlan, geneve, wireguard or bridge
+	Mode string `json:"mode,omitempty"`
+	// Interfaces is a regex matching the host interfaces used in host mode
+	Interfaces string `json:"interfaces,omitempty"`
+	// Routes installed inside the container through the devices of the pool,
+	// in addition to the routes the host interfaces had in the host
+	Routes []hookconfig.Route `json:"routes,omitempty"`
+	// Table is the routing table used by the devices of the pool inside the
+	// container, with source based rules for the device addresses
+	Table int `json:"table,omitempty"`
+	// RulePriority is the priority of the source based rules
+	RulePriority int `json:"rulePriority,omitempty"`
+	// Link profile applied to the devices inside the container
+	Link *hookconfig.Link `json:"link,omitempty"`
+	// Sysctls applied inside the container for the devices of the pool
+	Sysctls []hookconfig.Sysctl `json:"sysctls,omitempty"`
+	// DHCP obtains the addresses of the devices inside the container instead
+	// of using the addresses the host interfaces had in the host
+	DHCP *hookconfig.DHCP `json:"dhcp,omitempty"`
+	// DAD configures the duplicate address detection and the announcements
+	// of the addresses once the devices are up inside the container
+	DAD *hookconfig.DAD `json:"dad,omitempty"`
+	// Readiness conditions the devices have to meet before the container starts
+	Readiness *hookconfig.Readiness `json:"readiness,omitempty"`
+	// FailurePolicy decides which failures of the hooks abort the creation
+	// of the container and which ones let it start without the device or
+	// part of its configuration
+	FailurePolicy *hookconfig.FailurePolicy `json:"failurePolicy,omitempty"`
+	// IPAM is the ipam section of a CNI network configuration, the IPAM plugin
+	// assigns the addresses of the devices on each allocation, i.e.
+	// {"type": "host-local", "ranges": [[{"subnet": "192.168.10.0/24"}]]}
+	IPAM json.RawMessage `json:"ipam,omitempty"`
+	// InterfaceName is the template of the interface name inside the container,
+	// {index} is replaced by the position of the device in the container
+	// allocation starting on 1 and {device} by the device name, defaults to net{index}
+	InterfaceName string `json:"interfaceName,omitempty"`
+	// Capacity is the number of devices that can be created in virtual modes
+	Capacity int `json:"capacity,omitempty"`
+	// Tunnel parameters used in the tunnel modes
+	Tunnel *tunnelConfig `json:"tunnel,omitempty"`
+	// Bridge parameters used in bridge mode
+	Bridge *bridgeConfig `json:"bridge,omitempty"`
+}
+
+// tunnelConfig contains the parameters of the tunnel devices of a pool, the
+// device with index i of the pool uses the VNI and the port incremented by i
+// so the tunnels of the same pool do not collide on the host.
+type tunnelConfig struct {
+	// VNI of the first device of the pool (vxlan and geneve)
+	VNI int `json:"vni,omitempty"`
+	// Remote endpoint address (vxlan and geneve)
+	Remote string `json:"remote,omitempty"`
+	// Local source address (vxlan)
+	Local string `json:"local,omitempty"`
+	// Port is the UDP destination port (vxlan and geneve) or the listen port (wireguard)
+	Port int `json:"port,omitempty"`
+	// Device is the underlay interface (vxlan)
+	Device string `json:"device,omitempty"`
+	// MTU of the tunnel devices
+	MTU int `json:"mtu,omitempty"`
+}
+
+// bridgeConfig contains the parameters of the device pairs created in bridge
+// mode, one end is moved to the pod and the other is attached to the bridge.
+type bridgeConfig struct {
+	// Name of the Linux bridge
+	Name string `json:"name"`
+	// Netkit creates netkit pairs instead of veth pairs if the kernel supports them
+	Netkit bool `json:"netkit,omitempty"`
+	// MTU of the pair
+	MTU int `json:"mtu,omitempty"`
+}
+
+// defaultConfig returns the configuration used when no configuration file is
+// provided, a single pool exposing the host interfaces matching the regex.
+func defaultConfig(regex string) *config {
+	return &config{
+		Pools: []poolConfig{{
+			Name:         pluginName,
+			ResourceName: resourceName,
+			Mode:         modeHost,
+			Interfaces:   regex,
+		}},
+	}
+}
+
+func loadConfig(file string) (*config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", file, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", file, err)
+	}
+	return cfg, nil
+}
+
+// validate checks the configuration and sets the default values
+func (c *config) validate() error {
+	if len(c.Pools) == 0 {
+		return fmt.Errorf("no pools defined")
+	}
+	names := map[string]bool{}
+	resources := map[string]bool{}
+	templates := map[string]string{}
+	for i := range c.Pools {
+		pool := &c.Pools[i]
+		if pool.Name == "" {
+			return fmt.Errorf("pool %d has no name", i)
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("duplicate pool %s", pool.Name)
+		}
+		names[pool.Name] = true
+		if pool.ResourceName == "" {
+			pool.ResourceName = "networking.k8s.io/" + pool.Name
+		}
+		if resources[pool.ResourceName] {
+			return fmt.Errorf("duplicate resource name %s in pool %s", pool.ResourceName, pool.Name)
+		}
+		resources[pool.ResourceName] = true
+		if pool.Mode == "" {
+			pool.Mode = modeHost
+		}
+		if pool.InterfaceName == "" {
+			pool.InterfaceName = defaultInterfaceName
+		}
+		if strings.ContainsAny(pool.InterfaceName, "/: \t\n") {
+			return fmt.Errorf("pool %s interface name %q contains invalid characters", pool.Name, pool.InterfaceName)
+		}
+		// the pods requesting devices from different pools get all of them
+		if other, ok := templates[pool.InterfaceName]; ok {
+			return fmt.Errorf("pools %s and %s use the same interface name %q", other, pool.Name, pool.InterfaceName)
+		}
+		templates[pool.InterfaceName] = pool.Name
+
+		for _, route := range pool.Routes {
+			if err := route.Validate(); err != nil {
+				return fmt.Errorf("pool %s has an invalid route: %w", pool.Name, err)
+			}
+		}
+		if pool.Table < 0 || pool.RulePriority < 0 {
+			return fmt.Errorf("pool %s has an invalid table or rule priority", pool.Name)
+		}
+		if pool.Link != nil {
+			if err := pool.Link.Validate(); err != nil {
+				return fmt.Errorf("pool %s has an invalid link profile: %w", pool.Name, err)
+			}
+		}
+		for _, sysctl := range pool.Sysctls {
+			if err := sysctl.Validate(); err != nil {
+				return fmt.Errorf("pool %s: %w", pool.Name, err)
+			}
+		}
+		if pool.DHCP != nil {
+			if err := pool.DHCP.Validate(); err != nil {
+				return fmt.Errorf("pool %s has an invalid dhcp configuration: %w", pool.Name, err)
+			}
+		}
+		if pool.DAD != nil {
+			if err := pool.DAD.Validate(); err != nil {
+				return fmt.Errorf("pool %s has an invalid dad configuration: %w", pool.Name, err)
+			}
+		}
+		if pool.Readiness != nil {
+			if err := pool.Readiness.Validate(); err != nil {
+				return fmt.Errorf("pool %s has invalid readiness conditions: %w", pool.Name, err)
+			}
+		}
+		if pool.FailurePolicy != nil {
+			if err := pool.FailurePolicy.Validate(); err != nil {
+				return fmt.Errorf("pool %s has an invalid failure policy: %w", pool.Name, err)
+			}
+		}
+		if len(pool.IPAM) > 0 {
+			if pool.DHCP != nil {
+				return fmt.Errorf("pool %s can not use ipam and dhcp at the same time", pool.Name)
+			}
+			if _, ipamType, err := pool.ipamNetConf(); err != nil || ipamType == "" {
+				return fmt.Errorf("pool %s ipam requires an object with the type of the IPAM plugin", pool.Name)
+			}
+		}
+
+		switch pool.Mode {
+		case modeHost:
+			if _, err := regexp.Compile(pool.Interfaces); err != nil {
+				return fmt.Errorf("pool %s interfaces is not a valid regular expression: %w", pool.Name, err)
+			}
+		case modeVxlan, modeGeneve, modeWireguard, modeBridge:
+			if pool.Capacity <= 0 {
+				return fmt.Errorf("pool %s requires a positive capacity", pool.Name)
+			}
+			longest := pool.deviceName(pool.Capacity - 1)
+			if pool.Mode == modeBridge {
+				longest = hostEndName(longest)
+			}
+			if len(longest) > maxIfNameLen {
+				return fmt.Errorf("pool %s name is too long to be used as interface prefix", pool.Name)
+			}
+			if pool.Mode == modeBridge {
+				if pool.Bridge == nil || pool.Bridge.Name == "" {
+					return fmt.Errorf("pool %s requires a bridge name", pool.Name)
+				}
+				continue
+			}
+			if pool.Tunnel == nil {
+				pool.Tunnel = &tunnelConfig{}
+			}
+			if err := pool.Tunnel.validate(pool.Mode, pool.Capacity); err != nil {
+				return fmt.Errorf("pool %s: %w", pool.Name, err)
+			}
+		default:
+			return fmt.Errorf("pool %s has unknown mode %q", pool.Name, pool.Mode)
+		}
+	}
+	return nil
+}
+
+func (t *tunnelConfig) validate(mode string, capacity int) error {
+	if t.Remote != "" && net.ParseIP(t.Remote) == nil {
+		return fmt.Errorf("invalid remote address %q", t.Remote)
+	}
+	if t.Local != "" && net.ParseIP(t.Local) == nil {
+		return fmt.Errorf("invalid local address %q", t.Local)
+	}
+	if t.Port < 0 || t.Port > 65535 {
+		return fmt.Errorf("invalid port %d", t.Port)
+	}
+	switch mode {
+	case modeVxlan:
+		if t.Port == 0 {
+			t.Port = 4789
+		}
+	case modeGeneve:
+		if t.Remote == "" {
+			return fmt.Errorf("geneve requires a remote address")
+		}
+		if t.Port == 0 {
+			t.Port = 6081
+		}
+	case modeWireguard:
+		if t.Port == 0 {
+			t.Port = 51820
+		}
+		// each device listens on its own port
+		if t.Port+capacity-1 > 65535 {
+			return fmt.Errorf("port range %d-%d out of bounds", t.Port, t.Port+capacity-1)
+		}
+		return nil
+	}
+	// each device uses its own VNI
+	if t.VNI <= 0 || t.VNI+capacity-1 > maxVNI {
+		return fmt.Errorf("%s requires a VNI range between 1 and %d, got %d-%d", mode, maxVNI, t.VNI, t.VNI+capacity-1)
+	}
+	return nil
+}
+
+// socketName returns the name of the plugin socket used by the pool
+func (p poolConfig) socketName() string {
+	if p.Name == pluginName {
+		return pluginSocket
+	}
+	return pluginName + "-" + p.Name + ".sock"
+}
+
+// mtu returns the MTU configured for the virtual devices of the pool
+func (p poolConfig) mtu() int {
+	switch {
+	case p.Tunnel != nil:
+		return p.Tunnel.MTU
+	case p.Bridge != nil:
+		return p.Bridge.MTU
+	}
+	return 0
+}
+
+// interfaceName returns the name of the device inside the container
+func (p poolConfig) interfaceName(device string, index int) (string, error) {
+	name := strings.ReplaceAll(p.InterfaceName, "{index}", strconv.Itoa(index))
+	name = strings.ReplaceAll(name, "{device}", device)
+	if len(name) > maxIfNameLen {
+		return "", fmt.Errorf("interface name %q for device %s is longer than %d characters", name, device, maxIfNameLen)
+	}
+	return name, nil
+}
+
+// deviceName returns the name of the virtual device with the index passed as argument
+func (p poolConfig) deviceName(i int) string {
+	return p.Name + strconv.Itoa(i)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// substring of the error, empty if the configuration is valid
+		err string
+	}{
+		{
+			name:   "host pool",
+			config: `{"pools": [{"name": "netdevice", "interfaces": "eth[1-9]"}]}`,
+		},
+		{
+			name: "virtual pools",
+			config: `{"pools": [
+				{"name": "vx", "mode": "vxlan", "capacity": 4, "interfaceName": "vx{index}", "tunnel": {"vni": 100}},
+				{"name": "gn", "mode": "geneve", "capacity": 4, "interfaceName": "gn{index}", "tunnel": {"vni": 100, "remote": "192.168.1.1"}},
+				{"name": "wg", "mode": "wireguard", "capacity": 4, "interfaceName": "wg{index}"},
+				{"name": "br", "mode": "bridge", "capacity": 4, "interfaceName": "br{index}", "bridge": {"name": "br0"}}
+			]}`,
+		},
+		{
+			name:   "no pools",
+			config: `{"pools": []}`,
+			err:    "no pools defined",
+		},
+		{
+			name:   "pool without name",
+			config: `{"pools": [{"interfaces": "eth1"}]}`,
+			err:    "pool 0 has no name",
+		},
+		{
+			name:   "duplicate pool",
+			config: `{"pools": [{"name": "a", "interfaceName": "a{index}"}, {"name": "a", "interfaceName": "b{index}"}]}`,
+			err:    "duplicate pool a",
+		},
+		{
+			name:   "duplicate resource name",
+			config: `{"pools": [{"name": "a", "resourceName": "example.com/nic", "interfaceName": "a{index}"}, {"name": "b", "resourceName": "example.com/nic", "interfaceName": "b{index}"}]}`,
+			err:    "duplicate resource name example.com/nic in pool b",
+		},
+		{
+			name:   "unknown mode",
+			config: `{"pools": [{"name": "a", "mode": "macvlan"}]}`,
+			err:    `unknown mode "macvlan"`,
+		},
+		{
+			name:   "invalid regex",
+			config: `{"pools": [{"name": "a", "interfaces": "eth[1-"}]}`,
+			err:    "not a valid regular expression",
+		},
+		{
+			name:   "virtual pool without capacity",
+			config: `{"pools": [{"name": "vx", "mode": "vxlan", "tunnel": {"vni": 100}}]}`,
+			err:    "requires a positive capacity",
+		},
+		{
+			name:   "pool name too long for the devices",
+			config: `{"pools": [{"name": "longbridgepool", "mode": "bridge", "capacity": 100, "bridge": {"name": "br0"}}]}`,
+			err:    "name is too long",
+		},
+		{
+			name:   "bridge without name",
+			config: `{"pools": [{"name": "br", "mode": "bridge", "capacity": 1}]}`,
+			err:    "requires a bridge name",
+		},
+		{
+			name:   "geneve without remote",
+			config: `{"pools": [{"name": "gn", "mode": "geneve", "capacity": 1, "tunnel": {"vni": 100}}]}`,
+			err:    "geneve requires a remote address",
+		},
+		{
+			name:   "VNI out of range",
+			config: `{"pools": [{"name": "vx", "mode": "vxlan", "capacity": 2, "tunnel": {"vni": 16777215}}]}`,
+			err:    "requires a VNI range",
+		},
+		{
+			name:   "wireguard ports out of range",
+			config: `{"pools": [{"name": "wg", "mode": "wireguard", "capacity": 2, "tunnel": {"port": 65535}}]}`,
+			err:    "out of bounds",
+		},
+		{
+			name:   "ipam and dhcp",
+			config: `{"pools": [{"name": "a", "ipam": {"type": "host-local"}, "dhcp": {"ipv4": true}}]}`,
+			err:    "can not use ipam and dhcp",
+		},
+		{
+			name:   "ipam without type",
+			config: `{"pools": [{"name": "a", "ipam": {}}]}`,
+			err:    "requires an object with the type",
+		},
+		{
+			name:   "invalid interface name",
+			config: `{"pools": [{"name": "a", "interfaceName": "net/{index}"}]}`,
+			err:    "contains invalid characters",
+		},
+		{
+			name:   "interface name collision",
+			config: `{"pools": [{"name": "a"}, {"name": "b"}]}`,
+			err:    `pools a and b use the same interface name "net{index}"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config{}
+			if err := json.Unmarshal([]byte(tt.config), cfg); err != nil {
+				t.Fatal(err)
+			}
+			err := cfg.validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	cfg := &config{Pools: []poolConfig{
+		{Name: "a"},
+		{Name: "vx", Mode: modeVxlan, Capacity: 1, InterfaceName: "vx{index}", Tunnel: &tunnelConfig{VNI: 1}},
+		{Name: "wg", Mode: modeWireguard, Capacity: 1, InterfaceName: "wg{index}"},
+	}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	host := cfg.Pools[0]
+	if host.Mode != modeHost || host.ResourceName != "networking.k8s.io/a" || host.InterfaceName != defaultInterfaceName {
+		t.Errorf("unexpected defaults of the host pool %+v", host)
+	}
+	if port := cfg.Pools[1].Tunnel.Port; port != 4789 {
+		t.Errorf("expected the vxlan port 4789, got %d", port)
+	}
+	if port := cfg.Pools[2].Tunnel.Port; port != 51820 {
+		t.Errorf("expected the wireguard port 51820, got %d", port)
+	}
+}
+
+func TestInterfaceName(t *testing.T) {
+	tests := []struct {
+		template string
+		device   string
+		index    int
+		expected string
+		err      bool
+	}{
+		{template: defaultInterfaceName, device: "eth3", index: 1, expected: "net1"},
+		{template: defaultInterfaceName, device: "eth3", index: 12, expected: "net12"},
+		{template: "{device}", device: "eth3", index: 1, expected: "eth3"},
+		{template: "sr-{device}-{index}", device: "ens1f0", index: 2, expected: "sr-ens1f0-2"},
+		{template: "data", device: "eth3", index: 1, expected: "data"},
+		{template: "pod-{device}-{index}", device: "enp129s0f1", index: 1, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template+"/"+tt.device, func(t *testing.T) {
+			pool := poolConfig{Name: "a", InterfaceName: tt.template}
+			name, err := pool.interfaceName(tt.device, tt.index)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got name %s", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"k8s.io/klog/v2"
+
+	"github.com/aojea/network-device-plugin/pkg/dhcp"
+)
+
+// interval to check the leases handed over by the ifup hook
+const leaseCheckInterval = 10 * time.Second
+
+// renewLeases renews the DHCP leases obtained by the ifup hook inside the
+// containers, the leases of the namespaces that no longer exist are removed.
+func renewLeases(ctx context.Context) {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		leases, err := dhcp.List(dhcp.LeaseDir)
+		if err != nil {
+			klog.Infof("fail to list DHCP leases: %v", err)
+		}
+		for _, lease := range leases {
+			if _, err := os.Stat(lease.NetNS); errors.Is(err, os.ErrNotExist) {
+				klog.V(4).Infof("removing DHCP lease of interface %s, namespace %s does not exist", lease.Interface, lease.NetNS)
+				if err := lease.Remove(dhcp.LeaseDir); err != nil {
+					klog.Infof("fail to remove DHCP lease: %v", err)
+				}
+				continue
+			}
+			renewAt, err := lease.RenewAt()
+			if err != nil {
+				klog.Infof("invalid DHCP lease of interface %s in namespace %s: %v", lease.Interface, lease.NetNS, err)
+				continue
+			}
+			if renewAt.IsZero() || time.Now().Before(renewAt) {
+				continue
+			}
+			err = renewLease(ctx, lease)
+			if err != nil {
+				// retry on the next interval until the addresses expire
+				klog.Infof("fail to renew DHCP lease of interface %s in namespace %s: %v", lease.Interface, lease.NetNS, err)
+				continue
+			}
+			klog.V(4).Infof("renewed DHCP lease of interface %s in namespace %s", lease.Interface, lease.NetNS)
+			if err := lease.Write(dhcp.LeaseDir); err != nil {
+				klog.Infof("fail to store DHCP lease: %v", err)
+			}
+		}
+	}
+}
+
+// renewLease renews the lease inside the container namespace and refreshes
+// the addresses of the interface. The namespace is entered from a dedicated
+// goroutine, if the thread can not return to the host namespace the goroutine
+// exits with the thread locked and the runtime terminates the thread.
+func renewLease(ctx context.Context, lease *dhcp.Lease) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- renewLeaseInNetNS(ctx, lease)
+	}()
+	return <-errCh
+}
+
+func renewLeaseInNetNS(ctx context.Context, lease *dhcp.Lease) error {
+	ns, err := netns.GetFromPath(lease.NetNS)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	// Lock the OS Thread so we don't accidentally switch namespaces
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+	if err := netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("fail to enter namespace %s: %w", lease.NetNS, err)
+	}
+	defer func() {
+		// the thread is left locked so it is discarded when the goroutine
+		// exits if it can not go back to the host namespace
+		if err := netns.Set(origin); err != nil {
+			klog.Infof("fail to restore the host namespace: %v", err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+
+	link, err := netlink.LinkByName(lease.Interface)
+	if err != nil {
+		return err
+	}
+	if err := lease.Renew(ctx); err != nil {
+		return err
+	}
+	return lease.Apply(link)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+
+	"k8s.io/klog/v2"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+// hookDescriptor is the OCI hook declaration read by CRI-O and podman from
+// the hooks directories, version 1.0.0 of the schema
+// https://github.com/containers/common/blob/main/pkg/hooks/docs/oci-hooks.5.md
+type hookDescriptor struct {
+	Version string   `json:"version"`
+	Hook    hookCmd  `json:"hook"`
+	When    hookWhen `json:"when"`
+	Stages  []string `json:"stages"`
+}
+
+type hookCmd struct {
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+}
+
+// hookWhen injects the hook in the containers with an annotation matching the
+// key and value regular expressions
+type hookWhen struct {
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// writeHookDescriptors installs in the directory the descriptors of the oci
+// hook for the stages the devices are attached, configured and released, the
+// runtime injects them in the containers with the annotations that Allocate
+// adds for each device.
+func writeHookDescriptors(dir string) error {
+	when := hookWhen{
+		Annotations: map[string]string{
+			"^" + regexp.QuoteMeta(hookconfig.AnnotationPrefix) + ".+$": ".+",
+		},
+	}
+	for _, stage := range []string{"createRuntime", "createContainer", "poststop"} {
+		descriptor := hookDescriptor{
+			Version: "1.0.0",
+			Hook: hookCmd{
+				Path: path.Join(cdiBinPath, "oci"),
+				Args: []string{"oci", "-stage", stage, "-log", flagHookLog},
+			},
+			When:   when,
+			Stages: []string{stage},
+		}
+		file := filepath.Join(dir, fmt.Sprintf("%s-%s.json", pluginName, stage))
+		if err := writeJSON(file, descriptor); err != nil {
+			return fmt.Errorf("failed to write OCI hook descriptor %s: %w", file, err)
+		}
+		klog.V(2).Infof("Created OCI hook descriptor %s", file)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"k8s.io/klog/v2"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+const (
+	// directory where the addresses assigned by the IPAM plugins are stored,
+	// so they survive plugin restarts and can be released later
+	ipamStatePath = "/var/run/netdevice/ipam"
+	// CNI version used to talk with the IPAM plugins
+	ipamCNIVersion = "1.0.0"
+)
+
+// ipamAllocation is the addressing obtained from the IPAM plugin for a device
+type ipamAllocation struct {
+	Addresses []string           `json:"addresses"`
+	Routes    []hookconfig.Route `json:"routes,omitempty"`
+}
+
+// ipamNetConf returns the network configuration passed to the IPAM plugin,
+// the network name is used by plugins like host-local to store the
+// allocations so it is prefixed to avoid collisions with the CNI networks.
+func (p poolConfig) ipamNetConf() ([]byte, string, error) {
+	var ipam struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(p.IPAM, &ipam); err != nil {
+		return nil, "", err
+	}
+	conf, err := json.Marshal(map[string]interface{}{
+		"cniVersion": ipamCNIVersion,
+		"name":       pluginName + "-" + p.Name,
+		"ipam":       p.IPAM,
+	})
+	return conf, ipam.Type, err
+}
+
+// ipamArgs returns the CNI arguments used for a device, the device can only
+// be assigned to one pod at a time so it identifies the allocation. The IPAM
+// plugins do not configure the namespace, the one of the plugin is passed.
+func (p *plugin) ipamArgs(command, device string) *invoke.Args {
+	return &invoke.Args{
+		Command:     command,
+		ContainerID: p.pool.Name + "-" + device,
+		NetNS:       "/proc/self/ns/net",
+		IfName:      device,
+		Path:        flagCNIBinDir,
+	}
+}
+
+// ipamAdd obtains the addresses of the device from the IPAM plugin of the
+// pool, the previous allocation of the device is released first. It does not
+// access the state of the plugin so it can run without holding the lock, the
+// caller records the allocation.
+func (p *plugin) ipamAdd(ctx context.Context, device string) (*ipamAllocation, error) {
+	if err := p.ipamDel(ctx, device); err != nil {
+		return nil, err
+	}
+	conf, ipamType, err := p.pool.ipamNetConf()
+	if err != nil {
+		return nil, err
+	}
+	pluginPath, err := invoke.FindInPath(ipamType, filepath.SplitList(flagCNIBinDir))
+	if err != nil {
+		return nil, err
+	}
+	r, err := invoke.ExecPluginWithResult(ctx, pluginPath, conf, p.ipamArgs("ADD", device), nil)
+	if err != nil {
+		return nil, fmt.Errorf("IPAM plugin %s failed to allocate addresses for device %s: %w", ipamType, device, err)
+	}
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.IPs) == 0 {
+		return nil, fmt.Errorf("IPAM plugin %s returned no addresses for device %s", ipamType, device)
+	}
+
+	alloc := &ipamAllocation{}
+	for _, ip := range result.IPs {
+		alloc.Addresses = append(alloc.Addresses, ip.Address.String())
+	}
+	for _, route := range result.Routes {
+		r := hookconfig.Route{Destination: route.Dst.String()}
+		if route.GW != nil {
+			r.Gateway = route.GW.String()
+		}
+		alloc.Routes = append(alloc.Routes, r)
+	}
+	if err := writeJSON(p.ipamStateFile(device), alloc); err != nil {
+		// do not leak the addresses if they can not be tracked
+		_ = invoke.ExecPluginWithoutResult(ctx, pluginPath, conf, p.ipamArgs("DEL", device), nil)
+		return nil, err
+	}
+	return alloc, nil
+}
+
+// ipamDel releases the addresses of the device, it is a no-op if the device
+// has no addresses assigned by the IPAM plugin. As ipamAdd, the caller removes
+// the allocation from the state of the plugin.
+func (p *plugin) ipamDel(ctx context.Context, device string) error {
+	stateFile := p.ipamStateFile(device)
+	if _, err := os.Stat(stateFile); os.IsNotExist(err) {
+		return nil
+	}
+	conf, ipamType, err := p.pool.ipamNetConf()
+	if err != nil {
+		return err
+	}
+	pluginPath, err := invoke.FindInPath(ipamType, filepath.SplitList(flagCNIBinDir))
+	if err != nil {
+		return err
+	}
+	err = invoke.ExecPluginWithoutResult(ctx, pluginPath, conf, p.ipamArgs("DEL", device), nil)
+	if err != nil {
+		return fmt.Errorf("IPAM plugin %s failed to release addresses of device %s: %w", ipamType, device, err)
+	}
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *plugin) ipamStateFile(device string) string {
+	return filepath.Join(ipamStatePath, p.pool.Name, device+".json")
+}
+
+// loadIPAMState loads the allocations done before the plugin restarted
+func (p *plugin) loadIPAMState() {
+	entries, err := os.ReadDir(filepath.Join(ipamStatePath, p.pool.Name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Infof("fail to read IPAM state of pool %s: %v", p.pool.Name, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		device, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(ipamStatePath, p.pool.Name, entry.Name()))
+		if err != nil {
+			klog.Infof("fail to read IPAM state of device %s: %v", device, err)
+			continue
+		}
+		alloc := &ipamAllocation{}
+		if err := json.Unmarshal(data, alloc); err != nil {
+			klog.Infof("invalid IPAM state of device %s: %v", device, err)
+			continue
+		}
+		p.ipam[device] = alloc
+	}
+}
+
+// writeJSON writes the object to the file replacing it atomically
+func writeJSON(file string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
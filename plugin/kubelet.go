@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"tags.cncf.io/container-device-interface/pkg/cdi"
+)
+
+// How the CDI devices are passed to the runtime in the Allocate response
+const (
+	// cdiInjectionAuto uses the annotations if the kubelet is older than the
+	// version that passes the CDIDevices field by default
+	cdiInjectionAuto = "auto"
+	// cdiInjectionDevices uses the CDIDevices field
+	cdiInjectionDevices = "devices"
+	// cdiInjectionAnnotations uses the cdi.k8s.io annotations
+	cdiInjectionAnnotations = "annotations"
+	// cdiInjectionBoth uses the CDIDevices field and the annotations
+	cdiInjectionBoth = "both"
+)
+
+// the kubelet passes the CDIDevices field of the device plugin API to the
+// runtime by default since 1.29, the DevicePluginCDIDevices feature is beta
+var cdiDevicesVersion = version.MustParseGeneric("1.29.0")
+
+// resolveCDIInjection returns how the CDI devices are passed to the runtime,
+// the kubelet version is obtained from the Node object of the node where the
+// plugin runs, NODE_NAME, and the CDIDevices field is used if it can not be
+// obtained.
+func resolveCDIInjection(ctx context.Context, injection string) string {
+	if injection != cdiInjectionAuto {
+		return injection
+	}
+	kubeletVersion, err := getKubeletVersion(ctx)
+	if err != nil {
+		klog.Infof("can not get the kubelet version, using the CDIDevices field: %v", err)
+		return cdiInjectionDevices
+	}
+	if kubeletVersion.LessThan(cdiDevicesVersion) {
+		klog.Infof("kubelet version %s does not support the CDIDevices field, using CDI annotations", kubeletVersion)
+		return cdiInjectionAnnotations
+	}
+	return cdiInjectionDevices
+}
+
+func getKubeletVersion(ctx context.Context) (*version.Version, error) {
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		return nil, fmt.Errorf("NODE_NAME environment variable not set")
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return version.ParseGeneric(node.Status.NodeInfo.KubeletVersion)
+}
+
+// injectCDIDevices adds the CDI devices to the response, in the CDIDevices
+// field or as annotations built with the CDI helpers, one annotation per pool
+func (p *plugin) injectCDIDevices(resp *pluginapi.ContainerAllocateResponse, devices []string) error {
+	if cdiInjection != cdiInjectionAnnotations {
+		for _, name := range devices {
+			resp.CDIDevices = append(resp.CDIDevices, &pluginapi.CDIDevice{Name: name})
+		}
+	}
+	if cdiInjection == cdiInjectionAnnotations || cdiInjection == cdiInjectionBoth {
+		annotations, err := cdi.UpdateAnnotations(resp.Annotations, pluginName, p.pool.Name, devices)
+		if err != nil {
+			return fmt.Errorf("failed to add CDI annotations: %w", err)
+		}
+		resp.Annotations = annotations
+	}
+	return nil
+}
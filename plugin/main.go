@@ -11,9 +11,13 @@ import (
 	"os/signal"
 	"path"
 	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog/v2"
 	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -26,6 +30,9 @@ import (
 
 	"tags.cncf.io/container-device-interface/pkg/cdi"
 	"tags.cncf.io/container-device-interface/specs-go"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/hooklog"
 )
 
 //
@@ -46,17 +53,35 @@ const (
 	resourceName  = "networking.k8s.io/netdevice"
 	cdiPath       = "/var/run/cdi"
 	cdiBinPath    = "/opt/cdi/bin"
+	// the hooks are added to the containers by the runtime from the CDI spec
+	hookModeCDI = "cdi"
+	// the runtime runs the oci hook for all the containers, it finds the
+	// devices in the container environment
+	hookModeOCI = "oci"
+	// the plugin attaches the devices itself from the NRI events of the
+	// runtime, it finds the devices in the container environment
+	hookModeNRI = "nri"
 )
 
 var (
-	flagRegex string
+	flagRegex     string
+	flagConfig    string
+	flagCNIBinDir string
+	flagHookLog   string
+	flagHookMode  string
+	flagHooksDir  string
+	flagNRISocket string
+	// how the CDI devices are passed to the runtime, resolved on start
+	flagCDIInjection string
+	cdiInjection     = cdiInjectionDevices
 )
 
 // https://man7.org/linux/man-pages/man7/netdevice.7.html
 type netdevice struct {
 	Name      string
-	Addresses []string // IP/Mask format
+	Addresses []hookconfig.Address
 	MTU       int
+	Routes    []hookconfig.Route
 }
 
 var _ registerapi.RegistrationServer = &plugin{}
@@ -78,24 +103,58 @@ type plugin struct {
 	devices       []netdevice
 	regex         *regexp.Regexp
 	gwIface       string
+	pool          poolConfig
+	// virtual devices left in the host namespace not assigned to any pod
+	orphans map[string]time.Time
+	// devices in the CDI spec and the name they get inside the container
+	specDevices []netdevice
+	names       map[string]string
+	// addresses assigned by the IPAM plugin of the pool
+	ipam map[string]*ipamAllocation
+	// allocations of each device, the addresses of a device are not
+	// released if it was allocated again meanwhile
+	generations map[string]int
+	// devices with addresses seen attached to a pod, their addresses are
+	// released once the hooks return them to the host
+	attached sets.Set[string]
+	// serializes the executions of the IPAM plugin, it is taken before mu
+	// and mu is never held while the IPAM plugin runs
+	ipamMu sync.Mutex
+	// notified when the hooks attach or release the devices of a pod
+	released chan struct{}
 }
 
-func newCDISpec() *specs.Spec {
+func newCDISpec(kind string) *specs.Spec {
 	cdi := &specs.Spec{}
 	cdi.Version = specs.CurrentVersion // TODO to understand what is the minimum version supported in containerd, using 0.5 for safety
-	cdi.Kind = resourceName
+	cdi.Kind = kind
 	return cdi
 }
 
-func newPlugin() *plugin {
+func newPlugin(pool poolConfig) *plugin {
 	// https://github.com/cncf-tags/container-device-interface/blob/main/SPEC.md
-	return &plugin{
+	p := &plugin{
 		Version:      pluginapi.Version,
-		ResourceName: resourceName,
+		ResourceName: pool.ResourceName,
+		Name:         pool.Name,
 		Type:         registerapi.DevicePlugin,
-		Endpoint:     path.Join(pluginapi.DevicePluginPath, pluginSocket),
+		Endpoint:     path.Join(pluginapi.DevicePluginPath, pool.socketName()),
 		registry:     cdi.GetRegistry(cdi.WithSpecDirs(cdiPath)),
+		pool:         pool,
+		orphans:      map[string]time.Time{},
+		names:        map[string]string{},
+		ipam:         map[string]*ipamAllocation{},
+		generations:  map[string]int{},
+		attached:     sets.New[string](),
+		released:     make(chan struct{}, 1),
+	}
+	if pool.Mode == modeHost && pool.Interfaces != "" {
+		p.regex = regexp.MustCompile(pool.Interfaces)
 	}
+	if len(pool.IPAM) > 0 {
+		p.loadIPAMState()
+	}
+	return p
 }
 func (p *plugin) GetInfo(context.Context, *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
 	klog.V(2).Infof("GetInfo request")
@@ -136,107 +195,27 @@ func (p *plugin) ListAndWatch(_ *pluginapi.Empty, s pluginapi.DevicePlugin_ListA
 	}
 
 	for {
-		ifaces, err := net.Interfaces()
-		if err != nil {
-			klog.Infof("error getting system interfaces: %v", err)
-		}
+		var devices []netdevice
 		response := pluginapi.ListAndWatchResponse{}
-		devices := []netdevice{}
-		for _, iface := range ifaces {
-			klog.V(2).Infof("Checking iface %s", iface.Name)
-			// skip default interface
-			if iface.Name == p.gwIface {
-				continue
-			}
-			// only interested in interfaces that match the regex
-			if p.regex != nil && !p.regex.MatchString(iface.Name) {
-				continue
-			}
-
-			if iface.Flags&net.FlagLoopback == 1 {
-				continue
-			}
-
-			link, err := netlink.LinkByName(iface.Name)
-			if err != nil {
-				klog.Warningf("Error getting link by name %v", err)
-				continue
-			}
-			addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
-			if err != nil {
-				klog.Warningf("Error getting addresses by link %v", err)
-				continue
-			}
-			netdev := netdevice{
-				Name: iface.Name,
-				MTU:  iface.MTU,
-			}
-
-			for _, addr := range addrs {
-				netdev.Addresses = append(netdev.Addresses, addr.String())
-			}
-			devices = append(devices, netdev)
-
-			health := pluginapi.Unhealthy
-			if iface.Flags&net.FlagUp == 1 {
-				health = pluginapi.Healthy
-			}
-
-			// TODO we can get the driver to discriminate using getIfaceDriver
-			response.Devices = append(response.Devices, &pluginapi.Device{
-				ID:     iface.Name,
-				Health: health,
-			})
-
+		if p.pool.Mode == modeHost {
+			devices, response.Devices = p.hostDevices()
+		} else {
+			devices, response.Devices = p.virtualDevices()
 		}
 
 		klog.V(2).Infof("Found following ifaces %v", devices)
 		if len(response.Devices) > 0 {
 			p.mu.Lock()
-
-			// generate cdi config
-			cdiSpec := newCDISpec()
-			for _, netdev := range devices {
-				cdiSpec.Devices = append(cdiSpec.Devices, specs.Device{
-					Name: netdev.Name,
-					ContainerEdits: specs.ContainerEdits{
-						Hooks: []*specs.Hook{
-							{ // move from runtime ns to container ns
-								HookName: "createRuntime",
-								Path:     path.Join(cdiBinPath, "ifnetns"),
-								Args:     []string{netdev.Name},
-							},
-							{ // set interface up and TODO IP addresses
-								HookName: "createContainer",
-								Path:     path.Join(cdiBinPath, "ifup"),
-								Args:     append([]string{netdev.Name}, netdev.Addresses...),
-							},
-						},
-					},
-				})
-			}
-
-			specName, err := cdi.GenerateNameForSpec(cdiSpec)
-			if err != nil {
-				klog.V(2).Infof("failed to generate Spec name: %w", err)
-				continue
-			}
-
-			err = p.registry.SpecDB().WriteSpec(cdiSpec, specName)
+			err := p.writeCDISpec(devices)
 			if err != nil {
-				klog.V(2).Infof("failed to write Spec name: %w", err)
-				continue
-			}
-
-			klog.V(2).InfoS("Created CDI file", "path", cdiPath, "devices", devices)
-
-			// update kubelet
-			err = s.Send(&response)
-			if err != nil {
-				klog.V(2).Infof("Error sending message %v", err)
-				continue
+				klog.Infof("failed to write CDI spec: %v", err)
+			} else {
+				// update kubelet
+				err = s.Send(&response)
+				if err != nil {
+					klog.V(2).Infof("Error sending message %v", err)
+				}
 			}
-
 			// update local cache
 			p.devices = devices
 			p.mu.Unlock()
@@ -253,13 +232,255 @@ func (p *plugin) ListAndWatch(_ *pluginapi.Empty, s pluginapi.DevicePlugin_ListA
 				<-nlChannel
 			}
 		case <-timeout:
+		// a device was attached or released
+		case <-p.released:
 		}
 
 	}
+}
 
+// hostDevices returns the host interfaces that can be allocated
+func (p *plugin) hostDevices() ([]netdevice, []*pluginapi.Device) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		klog.Infof("error getting system interfaces: %v", err)
+	}
+	devices := []netdevice{}
+	pluginDevices := []*pluginapi.Device{}
+	for _, iface := range ifaces {
+		klog.V(2).Infof("Checking iface %s", iface.Name)
+		// skip default interface
+		if iface.Name == p.gwIface {
+			continue
+		}
+		// only interested in interfaces that match the regex
+		if p.regex != nil && !p.regex.MatchString(iface.Name) {
+			continue
+		}
+
+		if iface.Flags&net.FlagLoopback == 1 {
+			continue
+		}
+
+		link, err := netlink.LinkByName(iface.Name)
+		if err != nil {
+			klog.Warningf("Error getting link by name %v", err)
+			continue
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			klog.Warningf("Error getting addresses by link %v", err)
+			continue
+		}
+		netdev := netdevice{
+			Name: iface.Name,
+			MTU:  iface.MTU,
+		}
+
+		netdev.Addresses = hostAddresses(addrs)
+		netdev.Routes, err = hostRoutes(link)
+		if err != nil {
+			klog.Warningf("Error getting routes by link %v", err)
+			continue
+		}
+		devices = append(devices, netdev)
+
+		health := pluginapi.Unhealthy
+		if iface.Flags&net.FlagUp == 1 {
+			health = pluginapi.Healthy
+		}
+
+		// TODO we can get the driver to discriminate using getIfaceDriver
+		pluginDevices = append(pluginDevices, &pluginapi.Device{
+			ID:     iface.Name,
+			Health: health,
+		})
+	}
+	return devices, pluginDevices
+}
+
+// writeCDISpec generates the CDI spec with the hooks that move the devices to
+// the container namespace and configure them.
+func (p *plugin) writeCDISpec(devices []netdevice) error {
+	cdiSpec := newCDISpec(p.ResourceName)
+	specName, err := cdi.GenerateNameForSpec(cdiSpec)
+	if err != nil {
+		return fmt.Errorf("failed to generate Spec name: %w", err)
+	}
+
+	for _, netdev := range devices {
+		configPath := hookConfigPath(specName, netdev.Name)
+		if err := p.hookConfig(netdev).Write(configPath); err != nil {
+			return fmt.Errorf("failed to write hook config for device %s: %w", netdev.Name, err)
+		}
+		cdiSpec.Devices = append(cdiSpec.Devices, specs.Device{
+			Name: netdev.Name,
+			ContainerEdits: specs.ContainerEdits{
+				Hooks: []*specs.Hook{
+					{ // move from runtime ns to container ns and rename
+						HookName: "createRuntime",
+						Path:     path.Join(cdiBinPath, "ifnetns"),
+						Args:     []string{"ifnetns", "-config", configPath, "-log", flagHookLog},
+					},
+					{ // set interface addresses and up
+						HookName: "createContainer",
+						Path:     path.Join(cdiBinPath, "ifup"),
+						Args:     []string{"ifup", "-config", configPath, "-log", flagHookLog},
+					},
+					{ // return to the host namespace once the pod does not use it
+						HookName: "poststop",
+						Path:     path.Join(cdiBinPath, "ifrelease"),
+						Args:     []string{"ifrelease", "-config", configPath, "-log", flagHookLog},
+					},
+				},
+			},
+		})
+	}
+
+	err = p.registry.SpecDB().WriteSpec(cdiSpec, specName)
+	if err != nil {
+		return fmt.Errorf("failed to write Spec name: %w", err)
+	}
+
+	klog.V(2).InfoS("Created CDI file", "path", cdiPath, "devices", devices)
+	p.specDevices = devices
 	return nil
 }
 
+// hookConfigPath returns the path of the hook configuration of the device, in
+// a directory next to the CDI spec, the CDI registry does not parse
+// subdirectories
+func hookConfigPath(specName, device string) string {
+	return path.Join(cdiPath, specName, device+".json")
+}
+
+// hookConfig returns the configuration the hooks apply to the device
+func (p *plugin) hookConfig(netdev netdevice) *hookconfig.Config {
+	// the name inside the container is assigned on allocation
+	containerName, ok := p.names[netdev.Name]
+	if !ok {
+		containerName = netdev.Name
+	}
+	cfg := &hookconfig.Config{
+		Version:   hookconfig.Version,
+		Device:    netdev.Name,
+		Interface: containerName,
+	}
+	// the addressing of the host does not apply if it is obtained from the
+	// IPAM plugin or DHCP
+	if alloc, ok := p.ipam[netdev.Name]; ok {
+		for _, addr := range alloc.Addresses {
+			cfg.Addresses = append(cfg.Addresses, hookconfig.Address{Address: addr})
+		}
+		cfg.Routes = append(cfg.Routes, alloc.Routes...)
+	} else if p.pool.DHCP == nil && len(p.pool.IPAM) == 0 {
+		cfg.Addresses = append(cfg.Addresses, netdev.Addresses...)
+		cfg.Routes = append(cfg.Routes, netdev.Routes...)
+	}
+	// the routes of the pool are appended to the routes the device had in the host
+	cfg.Routes = append(cfg.Routes, p.pool.Routes...)
+	cfg.Table = p.pool.Table
+	cfg.RulePriority = p.pool.RulePriority
+	// the pool profile takes precedence over the MTU of the device
+	link := hookconfig.Link{MTU: netdev.MTU}
+	if p.pool.Link != nil {
+		link = *p.pool.Link
+		if link.MTU == 0 {
+			link.MTU = netdev.MTU
+		}
+	}
+	if link != (hookconfig.Link{}) {
+		cfg.Link = &link
+	}
+	cfg.Sysctls = p.pool.Sysctls
+	cfg.DHCP = p.pool.DHCP
+	cfg.DAD = p.pool.DAD
+	cfg.Readiness = p.pool.Readiness
+	cfg.FailurePolicy = p.pool.FailurePolicy
+	return cfg
+}
+
+// hostAddresses returns the addresses of the interface that have to be
+// configured inside the container, the addresses managed by the kernel are
+// skipped: the IPv6 link-local addresses are generated again when the
+// interface is up and the temporary addresses are derived from the others.
+func hostAddresses(addrs []netlink.Addr) []hookconfig.Address {
+	result := []hookconfig.Address{}
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if addr.Flags&(unix.IFA_F_TEMPORARY|unix.IFA_F_DADFAILED) != 0 {
+			continue
+		}
+		address := hookconfig.Address{Address: addr.IPNet.String()}
+		if addr.Peer != nil {
+			address.Peer = addr.Peer.String()
+		}
+		for name, scope := range hookconfig.AddressScopes {
+			if addr.Scope == scope && scope != unix.RT_SCOPE_UNIVERSE {
+				address.Scope = name
+			}
+		}
+		for name, flag := range hookconfig.AddressFlags {
+			if addr.Flags&flag != 0 {
+				address.Flags = append(address.Flags, name)
+			}
+		}
+		// keep the document stable across ListAndWatch iterations
+		sort.Strings(address.Flags)
+		// the lifetimes are not copied, the document is written long before
+		// the hook applies it and nothing renews the addresses inside the
+		// container, the addresses are permanent in the pod
+		result = append(result, address)
+	}
+	return result
+}
+
+// hostRoutes returns the routes of the main table through the link that
+// were not added by the kernel, the kernel adds again the subnet and link
+// local routes when the addresses are configured inside the container.
+func hostRoutes(link netlink.Link) ([]hookconfig.Route, error) {
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	result := []hookconfig.Route{}
+	for _, route := range routes {
+		if route.Protocol == unix.RTPROT_KERNEL {
+			continue
+		}
+		// routes with multiple paths may use other links
+		if len(route.MultiPath) > 0 {
+			continue
+		}
+		r := hookconfig.Route{
+			Metric: route.Priority,
+			OnLink: route.Flags&int(netlink.FLAG_ONLINK) != 0,
+		}
+		if route.Gw != nil {
+			r.Gateway = route.Gw.String()
+		}
+		switch {
+		case route.Dst != nil:
+			if route.Dst.IP.IsLinkLocalUnicast() || route.Dst.IP.IsMulticast() {
+				continue
+			}
+			r.Destination = route.Dst.String()
+		case route.Family == netlink.FAMILY_V6:
+			r.Destination = "::/0"
+		default:
+			r.Destination = "0.0.0.0/0"
+		}
+		if err := r.Validate(); err != nil {
+			klog.Infof("ignoring route %s on link %s: %v", route, link.Attrs().Name, err)
+			continue
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
 func getIfaceDriver(name string) (string, error) {
 	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_IP)
 	if err != nil {
@@ -277,31 +498,193 @@ func getIfaceDriver(name string) (string, error) {
 // Allocate which return list of devices.
 func (p *plugin) Allocate(ctx context.Context, in *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	klog.V(2).Infof("Allocate request: %v", in)
+	specName, err := cdi.GenerateNameForSpec(newCDISpec(p.ResourceName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate Spec name: %w", err)
+	}
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	out, a, err := p.allocateDevices(in, specName)
+	p.mu.Unlock()
+	if err != nil {
+		p.rollback(ctx, a)
+		return nil, err
+	}
+
+	// the IPAM plugins run without holding the lock, they can take as long
+	// as the exchanges with the IPAM servers
+	if len(p.pool.IPAM) > 0 {
+		p.ipamMu.Lock()
+		for _, id := range a.devices {
+			alloc, err := p.ipamAdd(ctx, id)
+			if err != nil {
+				p.ipamMu.Unlock()
+				p.rollback(ctx, a)
+				return nil, err
+			}
+			a.ipam[id] = alloc
+		}
+		p.ipamMu.Unlock()
+	}
+
+	p.mu.Lock()
+	for id, alloc := range a.ipam {
+		p.ipam[id] = alloc
+	}
+	// the hooks get the container interface names from the CDI spec
+	err = p.writeCDISpec(p.specDevices)
+	p.mu.Unlock()
+	if err != nil {
+		p.rollback(ctx, a)
+		return nil, err
+	}
+	klog.V(2).Infof("Allocate request response: %v", out)
+	return out, nil
+}
+
+// allocation tracks the resources taken by an Allocate request, so they are
+// released if the request fails
+type allocation struct {
+	// devices allocated by the request, the ones already attached to the pod
+	// are not included
+	devices []string
+	// host devices taken from the available ones
+	taken []netdevice
+	// virtual devices created in the host namespace
+	created []string
+	// addresses obtained from the IPAM plugin
+	ipam map[string]*ipamAllocation
+	// tokens of the allocation records passed in the environment
+	tokens []string
+}
+
+// allocateDevices takes the requested devices and builds the responses, the
+// lock has to be held. The allocation returned tracks what was done even if
+// it fails.
+func (p *plugin) allocateDevices(in *pluginapi.AllocateRequest, specName string) (*pluginapi.AllocateResponse, *allocation, error) {
+	a := &allocation{ipam: map[string]*ipamAllocation{}}
 	out := &v1beta1.AllocateResponse{
 		ContainerResponses: make([]*v1beta1.ContainerAllocateResponse, 0, len(in.ContainerRequests)),
 	}
+	// the kubelet allocates the devices of the init containers again for the
+	// next containers of the pod, the ones already attached to the pod are
+	// shared by all its containers and are not allocated again
+	attached := attachedDevices()
 	for _, request := range in.GetContainerRequests() {
 		// Pass the CDI device plugin with annotations or environment variables
 		// and add a hook on the CDI plugin that reads this and perform the
 		// ip link ethX set netns NS
-		resp := v1beta1.ContainerAllocateResponse{}
-		for _, id := range request.DevicesIDs {
-			if len(p.devices) == 0 {
-				return nil, fmt.Errorf("requested devices are not available %q", id)
+		resp := v1beta1.ContainerAllocateResponse{
+			Envs:        map[string]string{},
+			Annotations: map[string]string{},
+		}
+		var cdiDevices []string
+		for i, id := range request.DevicesIDs {
+			// the device is assigned again, gc waits for the kubelet to
+			// report the new assignment
+			delete(p.orphans, id)
+			if p.pool.Mode == modeHost {
+				// the kubelet tracks the assignments by the device ID, use
+				// the requested device so the addresses can be released
+				// when the pod is gone
+				found := false
+				for j, device := range p.devices {
+					if device.Name == id {
+						p.devices = append(p.devices[:j], p.devices[j+1:]...)
+						a.taken = append(a.taken, device)
+						found = true
+						break
+					}
+				}
+				if !found {
+					if _, ok := attached[id]; !ok {
+						return nil, a, fmt.Errorf("requested devices are not available %q", id)
+					}
+					p.keepInSpec(id)
+				}
+			} else if _, ok := attached[id]; !ok {
+				// virtual devices are created on each allocation
+				envs, err := p.allocateVirtual(id)
+				if err != nil {
+					return nil, a, err
+				}
+				a.created = append(a.created, id)
+				for k, v := range envs {
+					resp.Envs[k] = v
+				}
+			}
+			if _, ok := attached[id]; !ok {
+				a.devices = append(a.devices, id)
+				p.generations[id]++
+				p.attached.Delete(id)
+			}
+			// interface names inside the container start on 1
+			containerName, err := p.pool.interfaceName(id, i+1)
+			if err != nil {
+				return nil, a, err
+			}
+			if ifName, ok := attached[id]; ok {
+				containerName = ifName
+			}
+			p.names[id] = containerName
+			resp.Envs[envName(id, "INTERFACE")] = containerName
+
+			name := p.ResourceName + "=" + id
+			if flagHookMode != hookModeCDI {
+				// the global hook or the NRI plugin find the devices in
+				// the environment, that only has the token of the
+				// allocation record with the configuration path
+				token, err := hookconfig.NewAllocation(hookconfig.AllocationDir, p.ResourceName, id, hookConfigPath(specName, id))
+				if err != nil {
+					return nil, a, fmt.Errorf("failed to record the allocation of device %s: %w", id, err)
+				}
+				a.tokens = append(a.tokens, token)
+				resp.Envs[envName(id, "CONFIG")] = token
+				resp.Annotations[hookconfig.AnnotationPrefix+id] = token
+			} else {
+				cdiDevices = append(cdiDevices, name)
 			}
-			// pop the first device
-			name := resourceName + "=" + p.devices[0].Name
-			p.devices = p.devices[1:]
-			resp.CDIDevices = append(resp.CDIDevices, &pluginapi.CDIDevice{Name: name})
 			klog.V(2).Infof("Allocate request interface: %s", name)
 
 		}
+		if len(cdiDevices) > 0 {
+			if err := p.injectCDIDevices(&resp, cdiDevices); err != nil {
+				return nil, a, err
+			}
+		}
 		out.ContainerResponses = append(out.ContainerResponses, &resp)
 	}
-	klog.V(2).Infof("Allocate request response: %v", out)
-	return out, nil
+	return out, a, nil
+}
+
+// rollback releases the resources of a failed allocation, the lock must not
+// be held. The devices are not assigned to any pod so the kubelet can
+// allocate them again.
+func (p *plugin) rollback(ctx context.Context, a *allocation) {
+	p.ipamMu.Lock()
+	for id := range a.ipam {
+		if err := p.ipamDel(ctx, id); err != nil {
+			klog.Infof("fail to release the addresses of device %s: %v", id, err)
+		}
+	}
+	p.ipamMu.Unlock()
+	for _, token := range a.tokens {
+		if err := hookconfig.RemoveAllocation(hookconfig.AllocationDir, token); err != nil {
+			klog.Infof("fail to remove the allocation record %s: %v", token, err)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id := range a.ipam {
+		delete(p.ipam, id)
+	}
+	for _, id := range a.created {
+		for _, name := range p.pool.hostLinks(id) {
+			if err := deleteLink(p.pool.Name, name); err != nil {
+				klog.Infof("fail to delete link %s of device %s: %v", name, id, err)
+			}
+		}
+	}
+	p.devices = append(p.devices, a.taken...)
 }
 
 // GetDevicePluginOptions returns options to be communicated with Device Manager
@@ -351,6 +734,12 @@ func (p *plugin) run(ctx context.Context) error {
 		return err
 	}
 
+	// Delete the virtual devices and release the addresses that are not longer used
+	if p.pool.Mode != modeHost || len(p.pool.IPAM) > 0 || flagHookMode != hookModeCDI {
+		go p.gc(ctx)
+	}
+	go p.watchPods(ctx)
+
 	// Cleanup if socket is cancelled
 	go func() {
 		<-ctx.Done()
@@ -375,7 +764,7 @@ func (p *plugin) register(ctx context.Context) error {
 	client := pluginapi.NewRegistrationClient(conn)
 	_, err = client.Register(ctx, &pluginapi.RegisterRequest{
 		Version:      p.Version,
-		Endpoint:     pluginSocket,
+		Endpoint:     path.Base(p.Endpoint),
 		ResourceName: p.ResourceName,
 		Options: &pluginapi.DevicePluginOptions{
 			PreStartRequired: false,
@@ -393,6 +782,13 @@ func (p *plugin) register(ctx context.Context) error {
 func init() {
 	klog.InitFlags(nil)
 	flag.StringVar(&flagRegex, "interfaces", "", "regex matching the network interfaces used for allocations")
+	flag.StringVar(&flagConfig, "config", "", "path to the file with the device pools configuration, if set the interfaces flag is ignored")
+	flag.StringVar(&flagCNIBinDir, "cni-bin-dir", "/opt/cni/bin", "directories with the CNI IPAM plugins used by the pools, separated by colons")
+	flag.StringVar(&flagHookMode, "hook-mode", hookModeCDI, "how the hooks are installed, cdi adds them to the containers with CDI devices, oci passes the devices in the container environment to the oci hook installed globally in the runtime, nri attaches the devices from the plugin using the NRI socket of the runtime")
+	flag.StringVar(&flagCDIInjection, "cdi-injection", cdiInjectionAuto, "how the CDI devices are passed to the runtime: devices uses the CDIDevices field, annotations the cdi.k8s.io annotations for kubelets older than 1.29, both or auto to choose based on the kubelet version")
+	flag.StringVar(&flagHooksDir, "oci-hooks-dir", "", "directory where the OCI hook descriptors are installed for CRI-O, e.g. /etc/containers/oci/hooks.d, requires hook-mode oci")
+	flag.StringVar(&flagNRISocket, "nri-socket", "/var/run/nri/nri.sock", "path of the NRI socket of the runtime, requires hook-mode nri")
+	flag.StringVar(&flagHookLog, "hook-log", hooklog.OutputFile, "log output of the hooks, one of "+strings.Join(hooklog.Outputs, ", "))
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, "Usage: network-device-plugin [options]\n\n")
@@ -410,32 +806,57 @@ func main() {
 		klog.Fatalf("kubelet plugin path %s does not exist: %v", pluginapi.DevicePluginPath, err)
 	}
 
-	klog.Info("initializing plugin")
-	plugin := newPlugin()
-
-	if len(cdi.GetRegistry().GetErrors()) > 0 {
-		klog.Fatalf("CDI registry errors %v", cdi.GetRegistry().GetErrors())
-	}
-
 	// validate flags
-	if flagRegex != "" {
-		r, err := regexp.Compile(flagRegex)
+	cfg := defaultConfig(flagRegex)
+	if flagConfig != "" {
+		cfg, err = loadConfig(flagConfig)
 		if err != nil {
-			klog.Fatalf("flag regex is not a valid regular expression: %v", err)
+			klog.Fatalf("failed to load configuration: %v", err)
+		}
+	} else if err := cfg.validate(); err != nil {
+		klog.Fatalf("flag regex is not a valid regular expression: %v", err)
+	}
+	if err := cfg.checkHostLinks(); err != nil {
+		klog.Fatalf("failed to load configuration: %v", err)
+	}
+	if flagHookMode != hookModeCDI && flagHookMode != hookModeOCI && flagHookMode != hookModeNRI {
+		klog.Fatalf("flag hook-mode must be %s, %s or %s", hookModeCDI, hookModeOCI, hookModeNRI)
+	}
+	if !slices.Contains(hooklog.Outputs, flagHookLog) {
+		klog.Fatalf("flag hook-log must be one of %v", hooklog.Outputs)
+	}
+	switch flagCDIInjection {
+	case cdiInjectionAuto, cdiInjectionDevices, cdiInjectionAnnotations, cdiInjectionBoth:
+	default:
+		klog.Fatalf("flag cdi-injection must be one of %s, %s, %s or %s", cdiInjectionAuto, cdiInjectionDevices, cdiInjectionAnnotations, cdiInjectionBoth)
+	}
+	if flagHooksDir != "" {
+		if flagHookMode != hookModeOCI {
+			klog.Fatalf("flag oci-hooks-dir requires hook-mode %s", hookModeOCI)
+		}
+		if err := writeHookDescriptors(flagHooksDir); err != nil {
+			klog.Fatalf("failed to install the OCI hooks: %v", err)
 		}
-		plugin.regex = r
+	}
+
+	if len(cdi.GetRegistry().GetErrors()) > 0 {
+		klog.Fatalf("CDI registry errors %v", cdi.GetRegistry().GetErrors())
 	}
 
 	klog.Info("get default gateway interface")
-	plugin.gwIface, err = getDefaultGwIf()
+	gwIface, err := getDefaultGwIf()
 	if err != nil {
-		klog.Fatalf("kubelet plugin %s failed to find default interface: %v", plugin.Name, err)
+		klog.Fatalf("kubelet plugin %s failed to find default interface: %v", pluginName, err)
 	}
 
 	// trap Ctrl+C and call cancel on the context
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
+	if flagHookMode == hookModeCDI {
+		cdiInjection = resolveCDIInjection(ctx, flagCDIInjection)
+	}
+
 	// Enable signal handler
 	signalCh := make(chan os.Signal, 2)
 	defer func() {
@@ -444,14 +865,33 @@ func main() {
 	}()
 	signal.Notify(signalCh, os.Interrupt, unix.SIGINT)
 
-	if err := os.Remove(plugin.Endpoint); err != nil && !os.IsNotExist(err) {
-		klog.Info("error removing the plugin unix socket %s", plugin.Endpoint)
+	// one plugin per pool, each one registers its own resource
+	plugins := []*plugin{}
+	cancelPlugins := []context.CancelFunc{}
+	for _, pool := range cfg.Pools {
+		klog.Infof("initializing plugin for pool %s resource %s", pool.Name, pool.ResourceName)
+		plugin := newPlugin(pool)
+		plugin.gwIface = gwIface
+
+		if err := os.Remove(plugin.Endpoint); err != nil && !os.IsNotExist(err) {
+			klog.Infof("error removing the plugin unix socket %s", plugin.Endpoint)
+		}
+		klog.Infof("start plugin %s", plugin.Name)
+		ctxPlugin, cancelPlugin := context.WithCancel(ctx)
+		err = plugin.run(ctxPlugin)
+		if err != nil {
+			klog.Fatalf("Unable to start plugin %s: %v", plugin.Name, err)
+		}
+		plugins = append(plugins, plugin)
+		cancelPlugins = append(cancelPlugins, cancelPlugin)
 	}
-	klog.Info("start plugin")
-	ctxPlugin, cancelPlugin := context.WithCancel(ctx)
-	err = plugin.run(ctxPlugin)
-	if err != nil {
-		klog.Fatalf("Unable to start plugin: %v", err)
+
+	// the leases are stored by the hooks independently of the pool
+	go renewLeases(ctx)
+
+	// one NRI plugin attaches the devices of all the pools
+	if flagHookMode == hookModeNRI {
+		go runNRI(ctx, flagNRISocket)
 	}
 
 	ticker := time.NewTicker(time.Second * 15)
@@ -465,52 +905,59 @@ func main() {
 			klog.Info("Exiting: context cancelled")
 		case <-ticker.C:
 			// check if socket exists to detect kubelet restarts
-			_, err = os.Stat(plugin.Endpoint)
-			if err != nil && os.IsNotExist(err) {
-				klog.Info("restart plugin")
-				cancelPlugin()
-				ctxPlugin, cancelPlugin = context.WithCancel(ctx)
-				err = plugin.run(ctxPlugin)
-				if err != nil {
-					klog.Fatalf("Unable to start plugin: %v", err)
+			for i, plugin := range plugins {
+				_, err = os.Stat(plugin.Endpoint)
+				if err != nil && os.IsNotExist(err) {
+					klog.Infof("restart plugin %s", plugin.Name)
+					cancelPlugins[i]()
+					var ctxPlugin context.Context
+					ctxPlugin, cancelPlugins[i] = context.WithCancel(ctx)
+					err = plugin.run(ctxPlugin)
+					if err != nil {
+						klog.Fatalf("Unable to start plugin %s: %v", plugin.Name, err)
+					}
 				}
 			}
 		}
 	}
 }
 
+// getDefaultGwIf returns the interface of the default route, the IPv4 one is
+// preferred on dual-stack nodes.
 func getDefaultGwIf() (string, error) {
-	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
-	if err != nil {
-		return "", err
-	}
-
-	for _, r := range routes {
-		// no multipath
-		if len(r.MultiPath) == 0 {
-			if r.Gw == nil {
-				continue
-			}
-			intfLink, err := netlink.LinkByIndex(r.LinkIndex)
-			if err != nil {
-				log.Printf("Failed to get interface link for route %v : %v", r, err)
-				continue
-			}
-			return intfLink.Attrs().Name, nil
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return "", err
 		}
 
-		// multipath, use the first valid entry
-		// xref: https://github.com/vishvananda/netlink/blob/6ffafa9fc19b848776f4fd608c4ad09509aaacb4/route.go#L137-L145
-		for _, nh := range r.MultiPath {
-			if nh.Gw == nil {
-				continue
+		for _, r := range routes {
+			// no multipath
+			if len(r.MultiPath) == 0 {
+				if r.Gw == nil {
+					continue
+				}
+				intfLink, err := netlink.LinkByIndex(r.LinkIndex)
+				if err != nil {
+					log.Printf("Failed to get interface link for route %v : %v", r, err)
+					continue
+				}
+				return intfLink.Attrs().Name, nil
 			}
-			intfLink, err := netlink.LinkByIndex(r.LinkIndex)
-			if err != nil {
-				log.Printf("Failed to get interface link for route %v : %v", r, err)
-				continue
+
+			// multipath, use the first valid entry
+			// xref: https://github.com/vishvananda/netlink/blob/6ffafa9fc19b848776f4fd608c4ad09509aaacb4/route.go#L137-L145
+			for _, nh := range r.MultiPath {
+				if nh.Gw == nil {
+					continue
+				}
+				intfLink, err := netlink.LinkByIndex(nh.LinkIndex)
+				if err != nil {
+					log.Printf("Failed to get interface link for route %v : %v", r, err)
+					continue
+				}
+				return intfLink.Attrs().Name, nil
 			}
-			return intfLink.Attrs().Name, nil
 		}
 	}
 	return "", fmt.Errorf("not routes found")
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+func mustParseAddr(t *testing.T, s string) netlink.Addr {
+	t.Helper()
+	addr, err := netlink.ParseAddr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *addr
+}
+
+func TestHostAddresses(t *testing.T) {
+	global := mustParseAddr(t, "192.168.1.2/24")
+	peer := mustParseAddr(t, "10.0.0.1/32")
+	peer.Peer = &net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)}
+	site := mustParseAddr(t, "fec0::2/64")
+	site.Scope = unix.RT_SCOPE_SITE
+	flagged := mustParseAddr(t, "2001:db8::2/64")
+	flagged.Flags = unix.IFA_F_NODAD | unix.IFA_F_NOPREFIXROUTE
+	flagged.ValidLft = 3600
+	flagged.PreferedLft = 1800
+	linkLocal6 := mustParseAddr(t, "fe80::1/64")
+	linkLocal6.Scope = unix.RT_SCOPE_LINK
+	linkLocal4 := mustParseAddr(t, "169.254.1.1/16")
+	linkLocal4.Scope = unix.RT_SCOPE_LINK
+	temporary := mustParseAddr(t, "2001:db8::1234/64")
+	temporary.Flags = unix.IFA_F_TEMPORARY
+	dadFailed := mustParseAddr(t, "2001:db8::5/64")
+	dadFailed.Flags = unix.IFA_F_DADFAILED
+
+	got := hostAddresses([]netlink.Addr{global, peer, site, flagged, linkLocal6, linkLocal4, temporary, dadFailed})
+	expected := []hookconfig.Address{
+		{Address: "192.168.1.2/24"},
+		{Address: "10.0.0.1/32", Peer: "10.0.0.2/32"},
+		{Address: "fec0::2/64", Scope: "site"},
+		// the lifetimes are not copied
+		{Address: "2001:db8::2/64", Flags: []string{"nodad", "noprefixroute"}},
+		// only the IPv6 link-local addresses are generated by the kernel
+		{Address: "169.254.1.1/16", Scope: "link"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
+
+// linkNetNS creates a veth in a new network namespace with the address, the
+// calling thread is locked and left in that namespace until the test ends
+func linkNetNS(t *testing.T, name, address string) netlink.Link {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create network namespaces")
+	}
+	runtime.LockOSThread()
+	t.Cleanup(runtime.UnlockOSThread)
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := netns.Set(origin); err != nil {
+			t.Errorf("fail to return to the host namespace: %v", err)
+		}
+		origin.Close()
+	})
+	ns, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		PeerName:  name + "-peer",
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatal(err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := mustParseAddr(t, address)
+	if err := netlink.AddrAdd(link, &addr); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{name, name + "-peer"} {
+		if err := netlink.LinkSetUp(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: l}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return link
+}
+
+func TestHostRoutes(t *testing.T) {
+	link := linkNetNS(t, "routes0", "192.168.1.2/24")
+	gw := net.ParseIP("192.168.1.1")
+	for _, route := range []*netlink.Route{
+		// default route
+		{LinkIndex: link.Attrs().Index, Gw: gw, Priority: 100},
+		{LinkIndex: link.Attrs().Index, Dst: mustParseCIDR(t, "10.0.0.0/8"), Gw: gw},
+		{LinkIndex: link.Attrs().Index, Dst: mustParseCIDR(t, "172.16.0.0/16"), Gw: net.ParseIP("10.1.1.1"), Flags: int(netlink.FLAG_ONLINK)},
+		// routes the kernel adds again or that are not copied
+		{LinkIndex: link.Attrs().Index, Dst: mustParseCIDR(t, "169.254.0.0/16"), Scope: netlink.SCOPE_LINK},
+		{LinkIndex: link.Attrs().Index, Dst: mustParseCIDR(t, "224.0.0.0/4"), Scope: netlink.SCOPE_LINK},
+	} {
+		if err := netlink.RouteAdd(route); err != nil {
+			t.Fatalf("fail to add route %s: %v", route, err)
+		}
+	}
+
+	got, err := hostRoutes(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subnet route of the address is added by the kernel
+	expected := []hookconfig.Route{
+		{Destination: "0.0.0.0/0", Gateway: "192.168.1.1", Metric: 100},
+		{Destination: "10.0.0.0/8", Gateway: "192.168.1.1"},
+		{Destination: "172.16.0.0/16", Gateway: "10.1.1.1", OnLink: true},
+	}
+	if !sameRoutes(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipnet
+}
+
+// sameRoutes compares the routes regardless of the order the kernel lists them
+func sameRoutes(a, b []hookconfig.Route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	routes := map[hookconfig.Route]int{}
+	for _, r := range a {
+		routes[r]++
+	}
+	for _, r := range b {
+		if routes[r] == 0 {
+			return false
+		}
+		routes[r]--
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/nri/pkg/stub"
+	"k8s.io/klog/v2"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+	"github.com/aojea/network-device-plugin/pkg/nri"
+	"github.com/aojea/network-device-plugin/pkg/pod"
+)
+
+const (
+	// NRI plugins are called in the order of their index
+	nriPluginIdx = "10"
+	// interval between the attempts to connect to the runtime
+	nriRetryInterval = 5 * time.Second
+)
+
+// runNRI connects the plugin to the runtime NRI socket, it connects again if
+// the runtime restarts. The NRI plugin attaches and configures the devices
+// itself, no hook runs in the runtime, see the nri package.
+func runNRI(ctx context.Context, socket string) {
+	for {
+		closed := make(chan struct{})
+		n := nri.New(pod.StateDir, hookconfig.AllocationDir)
+		s, err := stub.New(n,
+			stub.WithPluginName(pluginName),
+			stub.WithPluginIdx(nriPluginIdx),
+			stub.WithSocketPath(socket),
+			// the stub exits the process by default
+			stub.WithOnClose(func() { close(closed) }),
+		)
+		if err == nil {
+			err = s.Start(ctx)
+		}
+		if err != nil {
+			klog.Infof("fail to connect to the NRI socket %s: %v", socket, err)
+		} else {
+			klog.Infof("NRI plugin connected to %s", socket)
+			select {
+			case <-ctx.Done():
+				s.Stop()
+				return
+			case <-closed:
+				klog.Infof("NRI connection closed")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(nriRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+
+	"github.com/aojea/network-device-plugin/pkg/pod"
+)
+
+// attachedDevices returns the devices the hooks attached to the pods that
+// still exist and their name inside the pod, the pods whose network
+// namespace is gone are ignored.
+func attachedDevices() map[string]string {
+	pods, err := pod.List(pod.StateDir)
+	if err != nil {
+		klog.Infof("fail to read the state of the pods: %v", err)
+	}
+	devices := map[string]string{}
+	for _, p := range pods {
+		if _, err := os.Stat(p.NetNS); err != nil {
+			continue
+		}
+		for _, a := range p.Devices {
+			devices[a.Device] = a.Interface
+		}
+	}
+	return devices
+}
+
+// keepInSpec adds the device to the CDI spec if it is no longer there, the
+// host devices disappear from the host when they are attached to a pod but
+// the next containers of the pod still reference them.
+func (p *plugin) keepInSpec(id string) {
+	for _, netdev := range p.specDevices {
+		if netdev.Name == id {
+			return
+		}
+	}
+	p.specDevices = append(p.specDevices, netdevice{Name: id})
+}
+
+// watchPods notifies the changes of the devices attached to the pods, the
+// ifrelease hook updates the state of the pod once the device is back in the
+// host namespace so it can be advertised again.
+func (p *plugin) watchPods(ctx context.Context) {
+	if err := os.MkdirAll(pod.StateDir, 0755); err != nil {
+		klog.Infof("fail to create the pods state directory: %v", err)
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Infof("fail to watch the state of the pods: %v", err)
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(pod.StateDir); err != nil {
+		klog.Infof("fail to watch the state of the pods: %v", err)
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watcher.Errors:
+			klog.Infof("error watching the state of the pods: %v", err)
+		case event := <-watcher.Events:
+			// the states are replaced by renaming the temporary files
+			if filepath.Ext(event.Name) != ".json" || event.Op&(fsnotify.Create|fsnotify.Remove) == 0 {
+				continue
+			}
+			if len(p.pool.IPAM) > 0 {
+				p.releaseDetached(ctx)
+			}
+			select {
+			case p.released <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// releaseDetached releases the addresses of the devices that ifrelease or the
+// NRI plugin returned to the host, the kubelet does not tell the plugin when
+// the pods are gone. The devices released while the plugin was not running
+// are collected by gc once the kubelet stops reporting them as assigned.
+func (p *plugin) releaseDetached(ctx context.Context) {
+	attached := attachedDevices()
+	release := map[string]int{}
+	p.mu.Lock()
+	for name := range p.ipam {
+		if _, ok := attached[name]; ok {
+			p.attached.Insert(name)
+			continue
+		}
+		if p.attached.Has(name) {
+			p.attached.Delete(name)
+			release[name] = p.generations[name]
+		}
+	}
+	p.mu.Unlock()
+	for name, generation := range release {
+		klog.Infof("releasing the addresses of device %s returned to the host", name)
+		if err := p.releaseAddresses(ctx, name, generation); err != nil {
+			klog.Infof("fail to release the addresses of device %s: %v", name, err)
+		}
+	}
+}
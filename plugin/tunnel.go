@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// createTunnel creates in the host namespace the tunnel device with the index
+// passed as argument and returns the environment variables that expose its
+// parameters to the container.
+// The tunnel sockets live in the namespace where the device was created, so
+// the tunnels keep using the host network after being moved to the pod.
+func createTunnel(pool poolConfig, name string, index int) (map[string]string, error) {
+	tunnel := pool.Tunnel
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.MTU = tunnel.MTU
+
+	envs := map[string]string{}
+	var link netlink.Link
+	switch pool.Mode {
+	case modeVxlan:
+		vni := tunnel.VNI + index
+		vxlan := &netlink.Vxlan{
+			LinkAttrs: attrs,
+			VxlanId:   vni,
+			Port:      tunnel.Port,
+			Learning:  true,
+		}
+		// the kernel uses the group attribute as remote address if unicast
+		if tunnel.Remote != "" {
+			vxlan.Group = net.ParseIP(tunnel.Remote)
+		}
+		if tunnel.Local != "" {
+			vxlan.SrcAddr = net.ParseIP(tunnel.Local)
+		}
+		if tunnel.Device != "" {
+			underlay, err := netlink.LinkByName(tunnel.Device)
+			if err != nil {
+				return nil, fmt.Errorf("fail to get underlay device %s: %w", tunnel.Device, err)
+			}
+			vxlan.VtepDevIndex = underlay.Attrs().Index
+		}
+		link = vxlan
+		envs[envName(name, "VNI")] = strconv.Itoa(vni)
+	case modeGeneve:
+		vni := tunnel.VNI + index
+		link = &netlink.Geneve{
+			LinkAttrs: attrs,
+			ID:        uint32(vni),
+			Remote:    net.ParseIP(tunnel.Remote),
+			Dport:     uint16(tunnel.Port),
+		}
+		envs[envName(name, "VNI")] = strconv.Itoa(vni)
+	case modeWireguard:
+		link = &netlink.Wireguard{LinkAttrs: attrs}
+	default:
+		return nil, fmt.Errorf("mode %s is not a tunnel", pool.Mode)
+	}
+
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("fail to create %s device %s: %w", pool.Mode, name, err)
+	}
+	if err := markLinks(pool.Name, name); err != nil {
+		_ = netlink.LinkDel(link)
+		return nil, err
+	}
+
+	if pool.Mode == modeWireguard {
+		port := tunnel.Port + index
+		publicKey, err := configureWireguard(name, port)
+		if err != nil {
+			_ = netlink.LinkDel(link)
+			return nil, err
+		}
+		envs[envName(name, "PUBLIC_KEY")] = publicKey
+		envs[envName(name, "LISTEN_PORT")] = strconv.Itoa(port)
+	}
+	return envs, nil
+}
+
+// configureWireguard sets a newly generated private key and the listen port
+// to the wireguard device and returns its public key.
+func configureWireguard(name string, port int) (string, error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return "", fmt.Errorf("fail to generate wireguard key: %w", err)
+	}
+	client, err := wgctrl.New()
+	if err != nil {
+		return "", fmt.Errorf("fail to create wireguard client: %w", err)
+	}
+	defer client.Close()
+
+	err = client.ConfigureDevice(name, wgtypes.Config{
+		PrivateKey: &key,
+		ListenPort: &port,
+	})
+	if err != nil {
+		return "", fmt.Errorf("fail to configure wireguard device %s: %w", name, err)
+	}
+	return key.PublicKey().String(), nil
+}
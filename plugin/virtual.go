@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/aojea/network-device-plugin/pkg/hookconfig"
+)
+
+const (
+	// https://kubernetes.io/docs/concepts/extend-kubernetes/compute-storage-net/device-plugins/#monitoring-device-plugin-resources
+	podResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+	// virtual devices that are not assigned to any pod during this period are deleted
+	gcGracePeriod = 2 * time.Minute
+	gcInterval    = time.Minute
+)
+
+// virtualDevices returns the devices of the pools that create the devices on
+// allocation, there is a fixed number of slots defined by the pool capacity.
+func (p *plugin) virtualDevices() ([]netdevice, []*pluginapi.Device) {
+	health := pluginapi.Healthy
+	// the devices can not be created without the bridge
+	if p.pool.Mode == modeBridge && !linksExist([]string{p.pool.Bridge.Name}) {
+		health = pluginapi.Unhealthy
+	}
+	devices := []netdevice{}
+	pluginDevices := []*pluginapi.Device{}
+	for i := 0; i < p.pool.Capacity; i++ {
+		name := p.pool.deviceName(i)
+		devices = append(devices, netdevice{
+			Name: name,
+			MTU:  p.pool.mtu(),
+		})
+		pluginDevices = append(pluginDevices, &pluginapi.Device{
+			ID:     name,
+			Health: health,
+		})
+	}
+	return devices, pluginDevices
+}
+
+// allocateVirtual creates the device for the slot requested, the kubelet only
+// assigns the same slot again once the previous pod has released it, so any
+// leftover of the previous allocation can be deleted.
+func (p *plugin) allocateVirtual(id string) (map[string]string, error) {
+	index := -1
+	for i := 0; i < p.pool.Capacity; i++ {
+		if p.pool.deviceName(i) == id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("requested device %q does not belong to pool %s", id, p.pool.Name)
+	}
+	for _, name := range p.pool.hostLinks(id) {
+		if err := deleteLink(p.pool.Name, name); err != nil {
+			return nil, err
+		}
+	}
+	if p.pool.Mode == modeBridge {
+		return nil, createPair(p.pool, id)
+	}
+	return createTunnel(p.pool, id, index)
+}
+
+// hostLinks returns the links in the host namespace that belong to the device
+func (p poolConfig) hostLinks(id string) []string {
+	if p.Mode == modeBridge {
+		return []string{id, hostEndName(id)}
+	}
+	return []string{id}
+}
+
+// poolAlias is the alias of the links the plugin creates for the pool, only
+// the links with the alias are deleted. The hooks replace the alias while the
+// device is in the pod and restore it when it is released.
+func poolAlias(pool string) string {
+	return pluginName + ":" + pool
+}
+
+// markLinks sets the alias of the pool to the links created by the plugin
+func markLinks(pool string, names ...string) error {
+	for _, name := range names {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("fail to get link %s: %w", name, err)
+		}
+		if err := netlink.LinkSetAlias(link, poolAlias(pool)); err != nil {
+			return fmt.Errorf("fail to set alias on link %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// poolLink returns the link of the host namespace that the plugin created for
+// the pool, nil if it does not exist. It fails if a link with that name exists
+// but the plugin did not create it.
+func poolLink(pool, name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("fail to get link %s: %w", name, err)
+	}
+	if link.Attrs().Alias != poolAlias(pool) {
+		return nil, fmt.Errorf("link %s exists in the host and was not created for pool %s", name, pool)
+	}
+	return link, nil
+}
+
+// checkHostLinks verifies that the devices of the virtual pools do not collide
+// with the host links, the ones created by a previous run of the plugin are
+// reused
+func (c *config) checkHostLinks() error {
+	for _, pool := range c.Pools {
+		if pool.Mode == modeHost {
+			continue
+		}
+		for i := 0; i < pool.Capacity; i++ {
+			for _, name := range pool.hostLinks(pool.deviceName(i)) {
+				if _, err := poolLink(pool.Name, name); err != nil {
+					return fmt.Errorf("pool %s: %w", pool.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// deleteLink deletes the link of the pool from the host namespace if exists,
+// the links not created by the plugin are never deleted
+func deleteLink(pool, name string) error {
+	link, err := poolLink(pool, name)
+	if link == nil {
+		return err
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("fail to delete link %s: %w", name, err)
+	}
+	return nil
+}
+
+// gc deletes the virtual devices that are still in the host namespace but are
+// no longer assigned to any pod, the devices that were moved to a pod are
+// destroyed by the kernel with the pod network namespace, including the host
+// end of the veth and netkit pairs. The addresses assigned by the IPAM plugin
+// to the devices no longer assigned are released, and so are their
+// allocation records.
+func (p *plugin) gc(ctx context.Context) {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		assigned, err := assignedDevices(ctx, p.ResourceName)
+		if err != nil {
+			klog.Infof("fail to get the devices assigned to pods: %v", err)
+			continue
+		}
+
+		// the tokens of the devices no longer assigned are not valid
+		if flagHookMode != hookModeCDI {
+			if err := hookconfig.PruneAllocations(hookconfig.AllocationDir, p.ResourceName, assigned.Has, gcGracePeriod); err != nil {
+				klog.Infof("fail to remove the allocation records: %v", err)
+			}
+		}
+
+		// the links are deleted holding the lock, the addresses are released
+		// once it is unlocked
+		release := map[string]int{}
+		p.mu.Lock()
+		for _, name := range p.gcCandidates() {
+			if assigned.Has(name) {
+				delete(p.orphans, name)
+				continue
+			}
+			if !p.inUse(name) {
+				delete(p.orphans, name)
+				continue
+			}
+			// allow some time for the kubelet to record the allocation
+			since, ok := p.orphans[name]
+			if !ok {
+				p.orphans[name] = time.Now()
+				continue
+			}
+			if time.Since(since) < gcGracePeriod {
+				continue
+			}
+			klog.Infof("releasing unassigned device %s from pool %s", name, p.pool.Name)
+			if err := p.deleteHostLinks(name); err != nil {
+				klog.Infof("fail to release unassigned device %s: %v", name, err)
+				continue
+			}
+			if _, ok := p.ipam[name]; ok {
+				release[name] = p.generations[name]
+				continue
+			}
+			delete(p.orphans, name)
+		}
+		p.mu.Unlock()
+
+		for name, generation := range release {
+			if err := p.releaseAddresses(ctx, name, generation); err != nil {
+				klog.Infof("fail to release the addresses of unassigned device %s: %v", name, err)
+				continue
+			}
+			p.mu.Lock()
+			if p.generations[name] == generation {
+				delete(p.orphans, name)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// gcCandidates returns the devices that may hold resources on the host
+func (p *plugin) gcCandidates() []string {
+	names := sets.New[string]()
+	if p.pool.Mode != modeHost {
+		for i := 0; i < p.pool.Capacity; i++ {
+			names.Insert(p.pool.deviceName(i))
+		}
+	}
+	for name := range p.ipam {
+		names.Insert(name)
+	}
+	return sets.List(names)
+}
+
+// inUse returns true if the device still holds resources on the host
+func (p *plugin) inUse(name string) bool {
+	if _, ok := p.ipam[name]; ok {
+		return true
+	}
+	return p.pool.Mode != modeHost && poolLinksExist(p.pool.Name, p.pool.hostLinks(name))
+}
+
+// deleteHostLinks deletes the links of the virtual device from the host
+// namespace, the lock has to be held
+func (p *plugin) deleteHostLinks(name string) error {
+	if p.pool.Mode == modeHost {
+		return nil
+	}
+	for _, link := range p.pool.hostLinks(name) {
+		if err := deleteLink(p.pool.Name, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseAddresses releases the addresses the IPAM plugin assigned to the
+// device in the allocation with the generation, nothing is released if the
+// device was allocated again. The lock must not be held.
+func (p *plugin) releaseAddresses(ctx context.Context, name string, generation int) error {
+	p.ipamMu.Lock()
+	defer p.ipamMu.Unlock()
+	// Allocate runs the IPAM plugin holding ipamMu, the addresses of a new
+	// allocation are not recorded until it is released
+	p.mu.Lock()
+	current := p.generations[name]
+	p.mu.Unlock()
+	if current != generation {
+		return nil
+	}
+	if err := p.ipamDel(ctx, name); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(p.ipam, name)
+	p.mu.Unlock()
+	return nil
+}
+
+// linksExist returns true if any of the links exist in the host namespace
+func linksExist(names []string) bool {
+	for _, name := range names {
+		if _, err := netlink.LinkByName(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// poolLinksExist returns true if any of the links created for the pool exist
+// in the host namespace
+func poolLinksExist(pool string, names []string) bool {
+	for _, name := range names {
+		if link, err := poolLink(pool, name); err == nil && link != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// assignedDevices returns the devices of the resource that the kubelet has
+// assigned to the running pods.
+func assignedDevices(ctx context.Context, resource string) (sets.Set[string], error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, "unix://"+podResourcesSocket, grpc.WithBlock(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect %s, %v", podResourcesSocket, err)
+	}
+	defer conn.Close()
+
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+	resp, err := client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	devices := sets.New[string]()
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, dev := range container.GetDevices() {
+				if dev.GetResourceName() == resource {
+					devices.Insert(dev.GetDeviceIds()...)
+				}
+			}
+		}
+	}
+	return devices, nil
+}
+
+// envName returns the environment variable name used to expose a property of
+// the device to the container.
+func envName(device, key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, device)
+	return "NETDEVICE_" + name + "_" + key
+}